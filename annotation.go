@@ -0,0 +1,228 @@
+package scramPkg
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Feature is a struct comprising a single annotated feature from a GFF3 or GTF file.  Features that share an ID
+// (e.g. the exons of a GTF gene) are counted together.
+type Feature struct {
+	ID     string
+	SeqID  string
+	Type   string
+	Start  int    // Start is the feature start (starting at 1)
+	End    int    // End is the feature end (inclusive)
+	Strand string // Strand is "+", "-" or "." (unstranded)
+}
+
+// AnnotationLoad loads features from a GFF3 or GTF (.gtf extension) annotation file.  Only features with a type in
+// featureTypes are loaded, or all features if featureTypes is empty.  The feature ID is the GFF3 ID, Name or Parent
+// attribute, or the GTF gene_id attribute.
+// It returns a slice of features sorted by seqid and start position.
+func AnnotationLoad(annotationFile string, featureTypes []string) []*Feature {
+	gtf := strings.HasSuffix(strings.ToLower(annotationFile), ".gtf")
+	keepTypes := make(map[string]bool)
+	for _, featureType := range featureTypes {
+		keepTypes[featureType] = true
+	}
+	var features []*Feature
+	f, err := os.Open(annotationFile)
+	if err != nil {
+		fmt.Println("Problem opening annotation file " + annotationFile)
+		errorShutdown()
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		lineNo++
+		if line == "##FASTA" {
+			break
+		}
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 9 {
+			fmt.Println("Annotation file format problem - line " + strconv.Itoa(lineNo) + " of " + annotationFile +
+				" does not have 9 tab-separated columns")
+			errorShutdown()
+		}
+		if len(keepTypes) > 0 && !keepTypes[fields[2]] {
+			continue
+		}
+		start, startErr := strconv.Atoi(fields[3])
+		end, endErr := strconv.Atoi(fields[4])
+		if startErr != nil || endErr != nil || start < 1 || end < start {
+			fmt.Println("Annotation file format problem - bad coordinates on line " + strconv.Itoa(lineNo) +
+				" of " + annotationFile)
+			errorShutdown()
+		}
+		var id string
+		switch {
+		case gtf:
+			id = gtfAttributes(fields[8])["gene_id"]
+		default:
+			attributes := gffAttributes(fields[8])
+			for _, key := range []string{"ID", "Name", "Parent"} {
+				if id = attributes[key]; id != "" {
+					break
+				}
+			}
+		}
+		if id == "" {
+			id = fields[0] + ":" + fields[3] + "-" + fields[4]
+		}
+		features = append(features, &Feature{id, fields[0], fields[2], start, end, fields[6]})
+	}
+	sort.SliceStable(features, func(i, j int) bool {
+		if features[i].SeqID != features[j].SeqID {
+			return features[i].SeqID < features[j].SeqID
+		}
+		return features[i].Start < features[j].Start
+	})
+	fmt.Println("No. of annotated features: ", len(features))
+	return features
+}
+
+// Parses GFF3 column 9 key=value attributes, decoding escaped characters
+func gffAttributes(column string) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range strings.Split(column, ";") {
+		keyValue := strings.SplitN(strings.TrimSpace(attribute), "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		value, err := url.PathUnescape(keyValue[1])
+		if err != nil {
+			value = keyValue[1]
+		}
+		attributes[keyValue[0]] = value
+	}
+	return attributes
+}
+
+// Parses GTF column 9 key "value" attributes
+func gtfAttributes(column string) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range strings.Split(column, ";") {
+		keyValue := strings.SplitN(strings.TrimSpace(attribute), " ", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		attributes[keyValue[0]] = strings.Trim(strings.TrimSpace(keyValue[1]), "\"")
+	}
+	return attributes
+}
+
+// featureIndex is a collection of features for a single seqid, sorted by start position, for overlap queries
+type featureIndex struct {
+	features  []*Feature
+	maxLength int
+}
+
+// Indexes the features by seqid
+func indexFeatures(features []*Feature) map[string]*featureIndex {
+	featureIndexMap := make(map[string]*featureIndex)
+	for _, singleFeature := range features {
+		index, ok := featureIndexMap[singleFeature.SeqID]
+		if !ok {
+			index = &featureIndex{}
+			featureIndexMap[singleFeature.SeqID] = index
+		}
+		index.features = append(index.features, singleFeature)
+		if length := singleFeature.End - singleFeature.Start + 1; length > index.maxLength {
+			index.maxLength = length
+		}
+	}
+	for _, index := range featureIndexMap {
+		sort.SliceStable(index.features, func(i, j int) bool {
+			return index.features[i].Start < index.features[j].Start
+		})
+	}
+	return featureIndexMap
+}
+
+// overlapping returns the features that overlap the region start-end (1-based, inclusive)
+func (index *featureIndex) overlapping(start int, end int) []*Feature {
+	var overlaps []*Feature
+	// first feature that starts after the region ends
+	i := sort.Search(len(index.features), func(i int) bool { return index.features[i].Start > end })
+	for i--; i >= 0 && index.features[i].Start >= start-index.maxLength; i-- {
+		if index.features[i].End >= start {
+			overlaps = append(overlaps, index.features[i])
+		}
+	}
+	return overlaps
+}
+
+// Checks if a read strand satisfies the strand rule for a feature.  Unstranded features match either read strand.
+func strandMatches(readStrand string, featureStrand string, strandRule string) bool {
+	switch {
+	case strandRule == "either" || (featureStrand != "+" && featureStrand != "-"):
+		return true
+	case strandRule == "sense":
+		return readStrand == featureStrand
+	default:
+		return readStrand != featureStrand
+	}
+}
+
+// CompareFeatureCounts takes an alignment map, a sequence map and a slice of features (from AnnotationLoad) and returns
+// a map with the feature ID as key and the mean_se (mean and standard error) or individual counts of the reads aligned
+// to the feature as value - the same as CompareNoSplitCounts / CompareSplitCounts, so the output can be passed to Compare
+// and CompareToCsv.  A read is counted once per feature ID it overlaps, subject to the strandRule ("sense",
+// "antisense" or "either").  If split is true, read counts are split by the number of times a read aligns to all
+// reference sequences.
+func CompareFeatureCounts(alignmentMap map[string]map[string][]int, seqMap map[string]interface{},
+	features []*Feature, strandRule string, split bool) map[string]interface{} {
+	if strandRule != "sense" && strandRule != "antisense" && strandRule != "either" {
+		fmt.Println("\nStrand rule must be sense, antisense or either, not " + strandRule)
+		errorShutdown()
+	}
+	featureIndexMap := indexFeatures(features)
+	srnaAlignmentMap := calcTimesReadAligns(alignmentMap)
+	featureCounts := make(map[string]*countsAccumulator)
+	for header, alignment := range alignmentMap {
+		index, ok := featureIndexMap[header]
+		if !ok {
+			continue
+		}
+		for srna, positions := range alignment {
+			factor := 1.0
+			if split {
+				factor = 1.0 / float64(srnaAlignmentMap[srna])
+			}
+			for _, position := range positions {
+				strand := "+"
+				if position < 0 {
+					strand = "-"
+					position = 0 - position
+				}
+				counted := make(map[string]bool)
+				for _, overlap := range index.overlapping(position, position+len(srna)-1) {
+					if counted[overlap.ID] || !strandMatches(strand, overlap.Strand, strandRule) {
+						continue
+					}
+					counted[overlap.ID] = true
+					if _, ok := featureCounts[overlap.ID]; !ok {
+						featureCounts[overlap.ID] = &countsAccumulator{}
+					}
+					featureCounts[overlap.ID].add(seqMap[srna], factor)
+				}
+			}
+		}
+	}
+	cdpFeatureMap := make(map[string]interface{})
+	for id, acc := range featureCounts {
+		cdpFeatureMap[id] = acc.result()
+	}
+	return cdpFeatureMap
+}
@@ -0,0 +1,173 @@
+package scramPkg
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ProfileToBed writes the profile alignments to a BED file, with one feature per read placement.  The BED name is the
+// read sequence and the score is the read count scaled to 0-1000 against the highest count in the file, as BED scores
+// must be integers in that range.  The read count itself (the mean of replicate counts for individual counts), split
+// (or not) as it was in the profile alignments map, is written in an extra column.  If bed12 is true, BED12+1
+// features with a single block are written, otherwise BED6+1.
+func ProfileToBed(profileAlignmentsMap map[string]interface{}, refSlice []*HeaderRef, nt int, outPrefix string,
+	bed12 bool) {
+	outFile := outPrefix + "_" + strconv.Itoa(nt) + ".bed"
+	f := createOutFile(outFile)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	var maxCount float64
+	for _, ref := range refSlice {
+		if alignments, ok := profileAlignmentsMap[ref.Header]; ok {
+			for _, alignment := range *alignments.(*singleAlignments) {
+				maxCount = math.Max(maxCount, readMeanCount(alignment.Alignments))
+			}
+		}
+	}
+	for _, ref := range refSlice {
+		alignments, ok := profileAlignmentsMap[ref.Header]
+		if !ok {
+			continue
+		}
+		for _, alignment := range *alignments.(*singleAlignments) {
+			start := alignment.Pos - 1
+			end := start + len(alignment.Seq)
+			count := readMeanCount(alignment.Alignments)
+			fields := []string{ref.Header, strconv.Itoa(start), strconv.Itoa(end), alignment.Seq,
+				bedScore(count, maxCount), alignment.Strand}
+			if bed12 {
+				fields = append(fields, strconv.Itoa(start), strconv.Itoa(end), "0", "1",
+					strconv.Itoa(len(alignment.Seq))+",", "0,")
+			}
+			fields = append(fields, strconv.FormatFloat(count, 'f', 3, 64))
+			w.WriteString(strings.Join(fields, "\t") + "\n")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Println("\nCan't write " + outFile + ": " + err.Error())
+		errorShutdown()
+	}
+}
+
+// bedScore scales a count to a BED score - an integer from 0 to 1000, relative to the max. count
+func bedScore(count float64, maxCount float64) string {
+	if maxCount <= 0 {
+		return "0"
+	}
+	return strconv.Itoa(int(math.Round(1000 * math.Min(math.Max(count/maxCount, 0), 1))))
+}
+
+// ProfileToGff writes the profile alignments to a GFF3 file, with one sRNA feature per read placement.  The score is
+// the read count (the mean of replicate counts for individual counts).  The read sequence, count and standard error
+// (or individual counts) and the no. of times the read aligned are stored as attributes.
+func ProfileToGff(profileAlignmentsMap map[string]interface{}, refSlice []*HeaderRef, nt int, outPrefix string) {
+	outFile := outPrefix + "_" + strconv.Itoa(nt) + ".gff3"
+	f := createOutFile(outFile)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	w.WriteString("##gff-version 3\n")
+	for _, ref := range refSlice {
+		if _, ok := profileAlignmentsMap[ref.Header]; ok {
+			fmt.Fprintf(w, "##sequence-region %s 1 %d\n", gffEscape(ref.Header), len(ref.Seq))
+		}
+	}
+	featureNo := 0
+	for _, ref := range refSlice {
+		alignments, ok := profileAlignmentsMap[ref.Header]
+		if !ok {
+			continue
+		}
+		for _, alignment := range *alignments.(*singleAlignments) {
+			featureNo++
+			attributes := []string{"ID=srna_aln_" + strconv.Itoa(featureNo), "Name=" + alignment.Seq}
+			switch v := alignment.Alignments.(type) {
+			case *meanSe:
+				attributes = append(attributes, "count="+strconv.FormatFloat(v.Mean, 'f', 3, 64),
+					"se="+strconv.FormatFloat(v.Se, 'f', 8, 64))
+			case *[]float64:
+				var counts []string
+				for _, count := range *v {
+					counts = append(counts, strconv.FormatFloat(count, 'f', 3, 64))
+				}
+				attributes = append(attributes, "counts="+strings.Join(counts, ","))
+			}
+			attributes = append(attributes, "times_aligned="+strconv.Itoa(alignment.timesAligned))
+			fields := []string{gffEscape(ref.Header), "scram2", "sRNA", strconv.Itoa(alignment.Pos),
+				strconv.Itoa(alignment.Pos + len(alignment.Seq) - 1),
+				strconv.FormatFloat(readMeanCount(alignment.Alignments), 'f', 3, 64), alignment.Strand, ".",
+				strings.Join(attributes, ";")}
+			w.WriteString(strings.Join(fields, "\t") + "\n")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Println("\nCan't write " + outFile + ": " + err.Error())
+		errorShutdown()
+	}
+}
+
+// gffEscape percent encodes the characters that are reserved in a GFF3 seqid or attribute value
+func gffEscape(value string) string {
+	var escaped strings.Builder
+	for _, r := range value {
+		switch {
+		case r <= ' ' || r == 0x7f || strings.ContainsRune(";=&,%", r):
+			fmt.Fprintf(&escaped, "%%%02X", r)
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
+
+// LociToBed writes the loci (from FindLoci) to a BED6+1 file.  Loci are named locus_1, locus_2, etc. in order, the
+// score is the locus abundance scaled to 0-1000 against the most abundant locus, and the abundance itself is written
+// in an extra column.  Loci are not stranded - the strand bias is reported by LociToCsv and LociToGff.
+func LociToBed(loci []*Locus, outPrefix string) {
+	outFile := outPrefix + "_loci.bed"
+	f := createOutFile(outFile)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	var maxAbundance float64
+	for _, singleLocus := range loci {
+		maxAbundance = math.Max(maxAbundance, singleLocus.Abundance)
+	}
+	for i, singleLocus := range loci {
+		fields := []string{singleLocus.Header, strconv.Itoa(singleLocus.Start - 1), strconv.Itoa(singleLocus.End),
+			"locus_" + strconv.Itoa(i+1), bedScore(singleLocus.Abundance, maxAbundance), ".",
+			strconv.FormatFloat(singleLocus.Abundance, 'f', 3, 64)}
+		w.WriteString(strings.Join(fields, "\t") + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Println("\nCan't write " + outFile + ": " + err.Error())
+		errorShutdown()
+	}
+}
+
+// LociToGff writes the loci (from FindLoci) to a GFF3 file, with one unstranded biological_region feature per locus,
+// named as for LociToBed.  The score is the locus abundance, and the locus statistics are stored as attributes.
+func LociToGff(loci []*Locus, outPrefix string) {
+	outFile := outPrefix + "_loci.gff3"
+	f := createOutFile(outFile)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	w.WriteString("##gff-version 3\n")
+	for i, singleLocus := range loci {
+		attributes := []string{"ID=locus_" + strconv.Itoa(i+1),
+			"unique_reads=" + strconv.Itoa(singleLocus.UniqueReads), "reads=" + strconv.Itoa(singleLocus.Reads),
+			"dominant_length=" + strconv.Itoa(singleLocus.DominantLen),
+			"strand_bias=" + strconv.FormatFloat(singleLocus.StrandBias, 'f', 3, 64),
+			"complexity=" + strconv.FormatFloat(singleLocus.Complexity, 'g', 6, 64),
+			"phase_score=" + strconv.FormatFloat(singleLocus.PhaseScore, 'f', 3, 64)}
+		fields := []string{gffEscape(singleLocus.Header), "scram2", "biological_region",
+			strconv.Itoa(singleLocus.Start), strconv.Itoa(singleLocus.End), strconv.FormatFloat(singleLocus.Abundance, 'f', 3, 64), ".", ".",
+			strings.Join(attributes, ";")}
+		w.WriteString(strings.Join(fields, "\t") + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Println("\nCan't write " + outFile + ": " + err.Error())
+		errorShutdown()
+	}
+}
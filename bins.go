@@ -0,0 +1,167 @@
+package scramPkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+)
+
+// Bin is a struct comprising the summed counts of reads aligned to a window of a reference sequence.  Counts are
+// meanSe or individual counts.
+type Bin struct {
+	Start int // Start is the window start (from 5' fwd, starting at 1)
+	End   int // End is the window end (inclusive)
+	Fwd   interface{}
+	Rvs   interface{}
+}
+
+// BinProfile takes a profile alignments map (from ProfileSplit or ProfileNoSplit) and the reference slice as an input,
+// and sums the read counts on each strand in windows of window nt, starting every step nt (a step below 1 is set to the
+// window size).  A read is counted in every window containing its start position.  Counts are split (or not) as they
+// were in the profile alignments map, and standard errors are combined as for CompareNoSplitCounts.
+// It returns a map of ref_header:[bin,...], with the bins in window order.
+func BinProfile(profileAlignmentsMap map[string]interface{}, refSlice []*HeaderRef, window int,
+	step int) map[string][]*Bin {
+	if window < 1 {
+		window = 1
+	}
+	if step < 1 {
+		step = window
+	}
+	binMap := make(map[string][]*Bin)
+	for _, ref := range refSlice {
+		alignments, ok := profileAlignmentsMap[ref.Header]
+		if !ok {
+			continue
+		}
+		refLen := len(ref.Seq)
+		noBins := 1
+		if refLen > window {
+			noBins = (refLen-window+step-1)/step + 1
+		}
+		fwdAccs := make([]countsAccumulator, noBins)
+		rvsAccs := make([]countsAccumulator, noBins)
+		var template interface{}
+		for _, alignment := range *alignments.(*singleAlignments) {
+			template = alignment.Alignments
+			accs := fwdAccs
+			if alignment.Strand == "-" {
+				accs = rvsAccs
+			}
+			// windows i start at i*step+1, so contain pos if i*step+1 <= pos <= i*step+window
+			first := (alignment.Pos - window + step - 1) / step
+			if first < 0 {
+				first = 0
+			}
+			for i := first; i < noBins && i*step+1 <= alignment.Pos; i++ {
+				accs[i].add(alignment.Alignments, 1.0)
+			}
+		}
+		refBins := make([]*Bin, noBins)
+		for i := range refBins {
+			end := i*step + window
+			if end > refLen {
+				end = refLen
+			}
+			refBins[i] = &Bin{Start: i*step + 1, End: end, Fwd: fwdAccs[i].resultLike(template),
+				Rvs: rvsAccs[i].resultLike(template)}
+		}
+		binMap[ref.Header] = refBins
+	}
+	return binMap
+}
+
+// binValue returns the value to report in a single value track (bedGraph) for bin counts.  This is the mean count, or
+// the mean of the replicate counts.
+func binValue(counts interface{}) float64 {
+	switch v := counts.(type) {
+	case meanSe:
+		return v.Mean
+	case []float64:
+		if len(v) == 0 {
+			return 0.0
+		}
+		var total float64
+		for _, count := range v {
+			total += count
+		}
+		return total / float64(len(v))
+	}
+	return 0.0
+}
+
+// BinsToCsv writes the binned counts for each reference sequence to a csv file.
+func BinsToCsv(binMap map[string][]*Bin, refSlice []*HeaderRef, nt int, outPrefix string, fileOrder []string) {
+	writeTable(outPrefix+"_"+strconv.Itoa(nt)+"_bins.csv", nil, func(emit emitRow) error {
+		meanSeColumns := []string{"Header", "Start", "End", "Fwd count", "Fwd std. err", "Rvs count", "Rvs std. err"}
+		countsColumns := []string{"Header", "Start", "End"}
+		for _, strand := range []string{"Fwd ", "Rvs "} {
+			for _, file := range fileOrder {
+				countsColumns = append(countsColumns, strand+file)
+			}
+		}
+		var row []interface{}
+		for _, ref := range refSlice {
+			for _, singleBin := range binMap[ref.Header] {
+				row = append(row[:0], ref.Header, singleBin.Start, singleBin.End)
+				columns := countsColumns
+				for _, counts := range []interface{}{singleBin.Fwd, singleBin.Rvs} {
+					switch v := counts.(type) {
+					case meanSe:
+						row = append(row, v.Mean, stdErr(v.Se))
+						columns = meanSeColumns
+					case []float64:
+						for _, count := range v {
+							row = append(row, count)
+						}
+					}
+				}
+				if err := emit(columns, row); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// BinsToBedGraph writes the binned counts for each reference sequence to a pair of bedGraph files (fwd and rvs
+// strands).  bedGraph intervals can't overlap, so bins from overlapping windows (step < window) are refused.  Zero
+// count intervals are omitted.
+func BinsToBedGraph(binMap map[string][]*Bin, refSlice []*HeaderRef, nt int, outPrefix string) {
+	for _, ref := range refSlice {
+		refBins := binMap[ref.Header]
+		for i := 1; i < len(refBins); i++ {
+			if refBins[i].Start <= refBins[i-1].End {
+				fmt.Println("\nbedGraph bins can't overlap - the step must be at least the window size")
+				errorShutdown()
+			}
+		}
+	}
+	for _, strand := range []string{"fwd", "rvs"} {
+		outFile := outPrefix + "_" + strconv.Itoa(nt) + "_bins_" + strand + ".bedgraph"
+		err := writeFileAtomic(outFile, func(f io.Writer) error {
+			w := bufio.NewWriter(f)
+			fmt.Fprintf(w, "track type=bedGraph name=\"%s_%d_bins_%s\"\n", filepath.Base(outPrefix), nt, strand)
+			for _, ref := range refSlice {
+				for _, singleBin := range binMap[ref.Header] {
+					counts := singleBin.Fwd
+					if strand == "rvs" {
+						counts = singleBin.Rvs
+					}
+					if value := binValue(counts); value != 0 {
+						fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", ref.Header, singleBin.Start-1, singleBin.End,
+							strconv.FormatFloat(value, 'f', 3, 64))
+					}
+				}
+			}
+			return w.Flush()
+		})
+		if err != nil {
+			fmt.Println("\nCan't write " + outFile + ": " + err.Error())
+			errorShutdown()
+		}
+	}
+}
@@ -0,0 +1,326 @@
+// Command scram aligns small RNA reads to reference sequences or miRNAs and writes read profiles, comparisons of two
+// sets of reads, and per-reference statistics.
+//
+// Usage:
+//
+//	scram <command> [options]
+//
+// The commands are profile, compare, mirna and stats.  Run scram <command> -h for the options of a command.  Options
+// can also be set in a JSON, YAML or TOML config file (-config).  The options used are recorded in
+// <outFile>_config.json, and the inputs, read library totals and outputs of the run in <outFile>_manifest.json.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	scramPkg "github.com/sfletc/scram2pkg"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// command is a scram subcommand
+type command struct {
+	name        string
+	description string
+	twoSets     bool // twoSets is true if the command compares two sets of reads
+	lengths     bool // lengths is true if the command aligns reads of the lengths in -length
+	run         func(config *scramPkg.Config) error
+}
+
+var commands = []*command{
+	{"profile", "Align reads of each length to reference sequences and write the alignment profile",
+		false, true, runProfile},
+	{"compare", "Align two sets of reads of each length to reference sequences and compare the aligned counts",
+		true, true, runCompare},
+	{"mirna", "Align two sets of reads to mature miRNAs and compare the aligned counts", true, false, runMirna},
+	{"stats", "Compare two sets of reads of each length with summary statistics for each reference sequence",
+		true, true, runStats},
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// run runs the command in args, writing usage messages to stderr.  Once the command succeeds, the config is recorded
+// and the run manifest is written - otherwise the manifest is discarded.
+func run(args []string, stderr io.Writer) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(stderr)
+		return nil
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			config, err := parseConfig(cmd, args[1:], stderr)
+			switch {
+			case err == flag.ErrHelp:
+				return nil
+			case err != nil:
+				return err
+			}
+			manifest := config.Manifest()
+			defer manifest.Discard()
+			if err := cmd.run(config); err != nil {
+				return err
+			}
+			if err := config.Record(); err != nil {
+				return err
+			}
+			return manifest.Write(config.OutFile + "_manifest.json")
+		}
+	}
+	usage(stderr)
+	return errors.New("unknown command " + args[0])
+}
+
+// Prints the list of commands
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: scram <command> [options]\n\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintln(w, "\nRun scram <command> -h for the options of a command.")
+}
+
+// stringList is a flag of comma-separated strings
+type stringList struct{ values *[]string }
+
+func (l stringList) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l stringList) Set(text string) error {
+	*l.values = strings.Split(text, ",")
+	return nil
+}
+
+// intList is a flag of comma-separated ints
+type intList struct{ values *[]int }
+
+func (l intList) String() string {
+	if l.values == nil {
+		return ""
+	}
+	var parts []string
+	for _, value := range *l.values {
+		parts = append(parts, strconv.Itoa(value))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l intList) Set(text string) error {
+	*l.values = nil
+	for _, part := range strings.Split(text, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return errors.New("bad value " + part)
+		}
+		*l.values = append(*l.values, value)
+	}
+	return nil
+}
+
+// newFlagSet returns the flags for a command, setting the fields of config
+func newFlagSet(cmd *command, config *scramPkg.Config, configFile *string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: scram %s [options]\n\n%s.\n\nOptions:\n", cmd.name, cmd.description)
+		fs.PrintDefaults()
+	}
+	readsHelp := "Comma-separated read files"
+	if cmd.twoSets {
+		readsHelp = "Comma-separated read files for the first set of reads"
+		fs.Var(stringList{&config.ReadFileSet2}, "readFileSet2",
+			"Comma-separated read files for the second set of reads")
+	}
+	fs.Var(stringList{&config.ReadFileSet1}, "readFileSet1", readsHelp)
+	fs.StringVar(&config.AlignTo, "alignTo", config.AlignTo, "Reference sequence FASTA file (mature miRNAs for mirna)")
+	if cmd.lengths {
+		fs.Var(intList{&config.Length}, "length", "Comma-separated read lengths to align (e.g. 21,22,24)")
+	}
+	fs.StringVar(&config.OutFile, "outFile", config.OutFile, "Output file prefix (including the directory)")
+	fs.StringVar(&config.FileType, "fileType", config.FileType, "Read file type - cfa, clean, fa or fq")
+	fs.StringVar(&config.Adapter, "adapter", config.Adapter, "3' adapter sequence to trim (none if not set)")
+	fs.IntVar(&config.MinLen, "minLen", config.MinLen, "Min. read length to load")
+	fs.IntVar(&config.MaxLen, "maxLen", config.MaxLen, "Max. read length to load")
+	fs.Float64Var(&config.MinCount, "minCount", config.MinCount, "Min. read count (normalised, unless -noNorm) to load")
+	fs.BoolVar(&config.NoNorm, "noNorm", config.NoNorm, "Don't normalise read counts to reads per million")
+	fs.BoolVar(&config.NoSplit, "noSplit", config.NoSplit,
+		"Don't split the counts of reads that align to more than one sequence")
+	fs.BoolVar(&config.Indv, "indv", config.Indv, "Report individual read file counts, not mean and standard error")
+	fs.StringVar(&config.Format, "format", config.Format, "Output format - csv, tsv, jsonl or col")
+	fs.BoolVar(&config.Gzip, "gzip", config.Gzip, "Gzip compress the output")
+	fs.StringVar(configFile, "config", "", "JSON, YAML or TOML config file of options - flags take precedence")
+	return fs
+}
+
+// parseConfig parses the flags for a command over the config file (if any) or the default config, and checks the
+// config
+func parseConfig(cmd *command, args []string, stderr io.Writer) (*scramPkg.Config, error) {
+	config := scramPkg.DefaultConfig()
+	var configFile string
+	fs := newFlagSet(cmd, config, &configFile, stderr)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, errors.New("unexpected argument " + fs.Arg(0))
+	}
+	if configFile != "" {
+		fileConfig, err := loadConfig(configFile)
+		if err != nil {
+			return nil, err
+		}
+		// flags set on the command line take precedence over the config file
+		fileFlags := newFlagSet(cmd, fileConfig, new(string), ioutil.Discard)
+		fs.Visit(func(f *flag.Flag) {
+			if err == nil {
+				err = fileFlags.Set(f.Name, f.Value.String())
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		config = fileConfig
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if cmd.twoSets && len(config.ReadFileSet2) == 0 {
+		return nil, errors.New("readFileSet2 is required (see scram " + cmd.name + " -h)")
+	}
+	if cmd.lengths && len(config.Length) == 0 {
+		return nil, errors.New("length is required (see scram " + cmd.name + " -h)")
+	}
+	return config, nil
+}
+
+// loadConfig loads a run configuration from a JSON, YAML or TOML file (by extension).  Options not in the file take
+// their default values, and unknown options are an error.
+func loadConfig(configFile string) (*scramPkg.Config, error) {
+	var format string
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".json":
+		return scramPkg.LoadConfig(configFile)
+	case ".yaml", ".yml":
+		format = "yaml"
+	case ".toml":
+		format = "toml"
+	default:
+		return nil, fmt.Errorf("config file %s must have a .json, .yaml, .yml or .toml extension", configFile)
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	config := scramPkg.DefaultConfig()
+	switch format {
+	case "yaml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(config); err == io.EOF {
+			err = nil
+		}
+	case "toml":
+		var metadata toml.MetaData
+		metadata, err = toml.Decode(string(data), config)
+		if undecoded := metadata.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown option %s", undecoded[0])
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't load config file %s: %v", configFile, err)
+	}
+	return config, nil
+}
+
+// Counts the reads aligned to each reference sequence, split or not
+func compareCounts(config *scramPkg.Config, alignmentMap map[string]map[string][]int,
+	seqMap map[string]interface{}) map[string]interface{} {
+	if config.NoSplit {
+		return scramPkg.CompareNoSplitCounts(alignmentMap, seqMap)
+	}
+	return scramPkg.CompareSplitCounts(alignmentMap, seqMap)
+}
+
+func runProfile(config *scramPkg.Config) error {
+	refSlice := scramPkg.RefLoad(config.AlignTo)
+	seqMap, fileOrder := config.SeqLoad(config.ReadFileSet1)
+	for _, nt := range config.Length {
+		alignmentMap := scramPkg.AlignReads(seqMap, refSlice, nt)
+		var profileMap map[string]interface{}
+		if config.NoSplit {
+			profileMap = scramPkg.ProfileNoSplit(alignmentMap, seqMap)
+		} else {
+			profileMap = scramPkg.ProfileSplit(alignmentMap, seqMap)
+		}
+		err := scramPkg.ProfileToFile(profileMap, refSlice, nt, config.OutFile, fileOrder, config.OutputOptions())
+		if err != nil {
+			return errors.New("can't write profile output: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func runCompare(config *scramPkg.Config) error {
+	refSlice := scramPkg.RefLoad(config.AlignTo)
+	seqMap1, fileOrder1 := config.SeqLoad(config.ReadFileSet1)
+	seqMap2, fileOrder2 := config.SeqLoad(config.ReadFileSet2)
+	for _, nt := range config.Length {
+		counts1 := compareCounts(config, scramPkg.AlignReads(seqMap1, refSlice, nt), seqMap1)
+		counts2 := compareCounts(config, scramPkg.AlignReads(seqMap2, refSlice, nt), seqMap2)
+		err := scramPkg.CompareToFile(scramPkg.Compare(counts1, counts2), nt, config.OutFile, fileOrder1, fileOrder2,
+			config.OutputOptions())
+		if err != nil {
+			return errors.New("can't write compare output: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func runMirna(config *scramPkg.Config) error {
+	mirnaMap := scramPkg.MirLoad(config.AlignTo)
+	seqMap1, fileOrder1 := config.SeqLoad(config.ReadFileSet1)
+	seqMap2, fileOrder2 := config.SeqLoad(config.ReadFileSet2)
+	cdpMap := scramPkg.MirnaCompare(scramPkg.AlignMirnas(seqMap1, mirnaMap), scramPkg.AlignMirnas(seqMap2, mirnaMap),
+		config.NoSplit)
+	err := scramPkg.MirnaCompareToFile(cdpMap, scramPkg.MirnaAccessions(mirnaMap), config.OutFile, fileOrder1,
+		fileOrder2, config.OutputOptions())
+	if err != nil {
+		return errors.New("can't write mirna output: " + err.Error())
+	}
+	return nil
+}
+
+func runStats(config *scramPkg.Config) error {
+	refSlice := scramPkg.RefLoad(config.AlignTo)
+	seqMap1, fileOrder1 := config.SeqLoad(config.ReadFileSet1)
+	seqMap2, fileOrder2 := config.SeqLoad(config.ReadFileSet2)
+	for _, nt := range config.Length {
+		alignmentMap1 := scramPkg.AlignReads(seqMap1, refSlice, nt)
+		alignmentMap2 := scramPkg.AlignReads(seqMap2, refSlice, nt)
+		cdpMap := scramPkg.Compare(compareCounts(config, alignmentMap1, seqMap1),
+			compareCounts(config, alignmentMap2, seqMap2))
+		err := scramPkg.CompareStatsToFile(cdpMap, scramPkg.CompareRefStats(alignmentMap1, seqMap1, refSlice),
+			scramPkg.CompareRefStats(alignmentMap2, seqMap2, refSlice), nt, config.OutFile, fileOrder1, fileOrder2,
+			config.OutputOptions())
+		if err != nil {
+			return errors.New("can't write stats output: " + err.Error())
+		}
+	}
+	return nil
+}
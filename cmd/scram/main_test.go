@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	scramPkg "github.com/sfletc/scram2pkg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testData = "../../test_data/"
+
+func TestRunProfile(t *testing.T) {
+	out_prefix := filepath.Join(t.TempDir(), "out", "test")
+	err := run([]string{"profile", "-readFileSet1", testData + "test_seq_1.fa", "-alignTo",
+		testData + "test_ref_align.fa", "-length", "24", "-outFile", out_prefix}, &bytes.Buffer{})
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_24.csv")
+	csv_lines := strings.Split(strings.TrimSpace(string(csv_data)), "\n")
+	if err != nil || len(csv_lines) != 7 ||
+		csv_lines[1] != "ref_1,25,AAAAAAAAAAAAAAAAAAAAAAAA,1,+,100000.000,0.00000000,5" {
+		fmt.Println(err, string(csv_data))
+		t.Error("Profile command output is incorrect")
+	}
+	manifest_data, _ := ioutil.ReadFile(out_prefix + "_manifest.json")
+	if !strings.Contains(string(manifest_data), "\"path\": \""+out_prefix+"_24.csv\"") ||
+		!strings.Contains(string(manifest_data), "\"path\": \""+out_prefix+"_config.json\"") {
+		fmt.Println(string(manifest_data))
+		t.Error("Profile command manifest is incorrect")
+	}
+}
+
+func TestRunConfig(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(config, []byte(`{"readFileSet1": ["`+testData+`test_seq_1.fa"],
+		"readFileSet2": ["`+testData+`test_seq_1.fa", "`+testData+`test_seq_1.fa"], "alignTo": "`+testData+
+		`test_ref_align.fa", "length": [24], "indv": true, "format": "tsv", "minLen": 20}`), 0644)
+	out_prefix := filepath.Join(dir, "test")
+	err := run([]string{"compare", "-config", config, "-format", "csv", "-outFile", out_prefix}, &bytes.Buffer{})
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_24.csv")
+	csv_lines := strings.Split(strings.TrimSpace(string(csv_data)), "\n")
+	if err != nil || len(csv_lines) != 4 || csv_lines[1] != "ref_1,200000.000,200000.000,200000.000" {
+		fmt.Println(err, string(csv_data))
+		t.Error("Compare command output with a config file is incorrect")
+	}
+	recorded, err := scramPkg.LoadConfig(out_prefix + "_config.json")
+	if err != nil || recorded.Format != "csv" || recorded.MinLen != 20 || !recorded.Indv ||
+		len(recorded.ReadFileSet2) != 2 {
+		fmt.Println(recorded, err)
+		t.Error("Compare command config is not recorded")
+	}
+
+	// the output options in a config file apply to every command
+	ioutil.WriteFile(config, []byte(`{"readFileSet1": ["`+testData+`test_seq_6.fa"], "readFileSet2": ["`+testData+
+		`test_seq_6.fa"], "alignTo": "`+testData+`test_mir_align.fa", "minLen": 1, "format": "tsv", "gzip": true}`),
+		0644)
+	if err := run([]string{"mirna", "-config", config, "-outFile", out_prefix}, &bytes.Buffer{}); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(out_prefix + "_miR.tsv.gz"); err != nil {
+		t.Error("Mirna command output options from a config file are ignored")
+	}
+
+	ioutil.WriteFile(config, []byte(`{"alignTo": "ref.fa", "lenght": 24}`), 0644)
+	if err := run([]string{"compare", "-config", config}, &bytes.Buffer{}); err == nil ||
+		!strings.Contains(err.Error(), "lenght") {
+		t.Error("Unknown config file options should return an error")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	yaml_config := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(yaml_config, []byte("readFileSet1:\n  - a.fa\nalignTo: ref.fa\nlength: [21, 24]\nnoSplit: true\n"),
+		0644)
+	config, err := loadConfig(yaml_config)
+	if err != nil || !reflect.DeepEqual(config.Length, []int{21, 24}) || !config.NoSplit || config.MinLen != 18 ||
+		config.AlignTo != "ref.fa" {
+		fmt.Println(config, err)
+		t.Error("YAML config is not loaded")
+	}
+
+	toml_config := filepath.Join(dir, "config.toml")
+	ioutil.WriteFile(toml_config, []byte("readFileSet1 = [\"a.fa\"]\nalignTo = \"ref.fa\"\nlength = [21, 24]\n"+
+		"noSplit = true\n"), 0644)
+	toml_loaded, err := loadConfig(toml_config)
+	if err != nil || !reflect.DeepEqual(toml_loaded, config) {
+		fmt.Println(toml_loaded, err)
+		t.Error("TOML config is not loaded")
+	}
+
+	ioutil.WriteFile(toml_config, []byte("minLen = 18\nmaxLength = 30\n"), 0644)
+	if _, err := loadConfig(toml_config); err == nil || !strings.Contains(err.Error(), "maxLength") {
+		t.Error("Unknown TOML config options should return an error")
+	}
+	if _, err := loadConfig(filepath.Join(dir, "config.ini")); err == nil {
+		t.Error("Unknown config file types should return an error")
+	}
+}
+
+func TestRunMirnaStats(t *testing.T) {
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	err := run([]string{"mirna", "-readFileSet1", testData + "test_seq_6.fa", "-readFileSet2",
+		testData + "test_seq_6.fa", "-alignTo", testData + "test_mir_align.fa", "-minLen", "1", "-noSplit",
+		"-outFile", out_prefix}, &bytes.Buffer{})
+	mir_data, _ := ioutil.ReadFile(out_prefix + "_miR.csv")
+	if err != nil || !strings.Contains(string(mir_data), "mir_1,,500000.000,0.00000000,500000.000,0.00000000\n") {
+		fmt.Println(err, string(mir_data))
+		t.Error("Mirna command output is incorrect")
+	}
+
+	err = run([]string{"stats", "-readFileSet1", testData + "test_seq_1.fa", "-readFileSet2",
+		testData + "test_seq_1.fa", "-alignTo", testData + "test_ref_align.fa", "-length", "24", "-outFile",
+		out_prefix}, &bytes.Buffer{})
+	stats_data, _ := ioutil.ReadFile(out_prefix + "_24.csv")
+	if err != nil || !strings.Contains(string(stats_data), "ref_2,350000.000,0.00000000,350000.000,0.00000000,50,"+
+		"2,0.960,0.000,1.000,24:750000.000,") {
+		fmt.Println(err, string(stats_data))
+		t.Error("Stats command output is incorrect")
+	}
+
+	err = run([]string{"mirna", "-readFileSet1", testData + "test_seq_6.fa", "-readFileSet2",
+		testData + "test_seq_6.fa", "-alignTo", testData + "test_mir_align.fa", "-minLen", "1", "-noSplit",
+		"-format", "tsv", "-outFile", out_prefix}, &bytes.Buffer{})
+	tsv_data, _ := ioutil.ReadFile(out_prefix + "_miR.tsv")
+	if err != nil || !strings.Contains(string(tsv_data), "mir_1\t\t500000.000\t0.00000000\t500000.000\t0.00000000\n") {
+		fmt.Println(err, string(tsv_data))
+		t.Error("Mirna command tsv output is incorrect")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	var usage bytes.Buffer
+	if err := run([]string{"profile", "-h"}, &usage); err != nil ||
+		!strings.Contains(usage.String(), "Usage: scram profile") || !strings.Contains(usage.String(), "-length") {
+		t.Error("Profile help is incorrect")
+	}
+	for _, args := range [][]string{
+		{"align"},
+		{"profile", "-alignTo", "ref.fa", "-length", "24", "-outFile", "out"},
+		{"compare", "-readFileSet1", "a.fa", "-alignTo", "ref.fa", "-length", "24", "-outFile", "out"},
+		{"profile", "-readFileSet1", "a.fa", "-alignTo", "ref.fa", "-length", "24", "-outFile", "out", "-minLen",
+			"25"},
+		{"profile", "-readFileSet1", "a.fa", "-alignTo", "ref.fa", "-length", "21,x", "-outFile", "out"},
+	} {
+		if err := run(args, &bytes.Buffer{}); err == nil {
+			t.Error("Bad arguments should return an error: ", args)
+		}
+	}
+}
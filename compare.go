@@ -3,11 +3,15 @@ package scramPkg
 import (
 	"encoding/csv"
 	"fmt"
+	"github.com/montanaflynn/stats"
+	"io"
 	"log"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 //CompareNoSplitCounts takes and alignment map and returns a map with the ref_header as key and the
@@ -121,6 +125,56 @@ func calcHeaderMeanSe(countsErr []float64, counts float64, cdpAlignmentMap map[s
 	return cdpAlignmentMap
 }
 
+//countsAccumulator sums read counts (mean and se, or individual counts) aligned to a single feature.  Standard errors
+//are combined as for calcHeaderMeanSe.
+type countsAccumulator struct {
+	mean   float64
+	errs   []float64
+	counts []float64
+}
+
+//add adds the counts for a read (*meanSe or *[]float64), multiplied by factor
+func (acc *countsAccumulator) add(counts interface{}, factor float64) {
+	switch v := counts.(type) {
+	case *meanSe:
+		acc.mean += v.Mean * factor
+		acc.errs = append(acc.errs, v.Se*factor)
+	case *[]float64:
+		if acc.counts == nil {
+			acc.counts = make([]float64, len(*v))
+		}
+		for pos, i := range *v {
+			acc.counts[pos] += i * factor
+		}
+	}
+}
+
+//result returns the summed counts as a meanSe or a slice of individual counts
+func (acc *countsAccumulator) result() interface{} {
+	if acc.errs != nil {
+		var errSqSum float64
+		for _, errs := range acc.errs {
+			errSqSum += errs * errs
+		}
+		return meanSe{acc.mean, math.Sqrt(errSqSum)}
+	}
+	return acc.counts
+}
+
+//resultLike returns the summed counts, or zero counts of the same type as counts (*meanSe or *[]float64) if nothing
+//has been added
+func (acc *countsAccumulator) resultLike(counts interface{}) interface{} {
+	if acc.errs == nil && acc.counts == nil {
+		switch v := counts.(type) {
+		case *meanSe:
+			return meanSe{}
+		case *[]float64:
+			return make([]float64, len(*v))
+		}
+	}
+	return acc.result()
+}
+
 //Compare combines individual alignments for set sets of sequences (treatments).  It returns a map of ref header
 //as key and a slice of set 1 mean/se and set2 mean/se as value.
 func Compare(countsMap1 map[string]interface{}, countsMap2 map[string]interface{}) map[string]interface{} {
@@ -228,63 +282,287 @@ func MirnaCompare(mirnaAlignmentMap1 map[string]interface{},
 	return cdpFinalMap
 }
 
-//CompareToCsv writes the output to a csv file.
-func CompareToCsv(cdpAlignmentMap map[string]interface{}, nt int, outPrefix string, aFileOrder []string, bFileOrder []string) {
-	firstLine := true
-	var alignments [][]string
+//RefStats is a struct comprising summary statistics for the reads aligned to a single reference sequence
+type RefStats struct {
+	RefLen        int
+	DistinctReads int             // DistinctReads is the number of distinct read sequences aligned to the ref
+	FwdCoverage   float64         // FwdCoverage is the fraction of ref positions covered by a sense read
+	RvsCoverage   float64         // RvsCoverage is the fraction of ref positions covered by an antisense read
+	StrandBias    float64         // StrandBias is the proportion of aligned abundance on the sense strand
+	LenDist       map[int]float64 // LenDist is the aligned abundance for each read length
+}
 
-	for header, countStats := range cdpAlignmentMap {
-		switch v := countStats.(type) {
-		case compMeanSeOutput:
-			if firstLine {
-				alignments = append(alignments, []string{"Header", "Mean count 1", "Std. err 1", "Mean count 2",
-					"Std. err 2"})
-				firstLine = false
-			} else {
-				alignment := []string{header,
-					strconv.FormatFloat(v.output[0], 'f', 3, 64),
-					strconv.FormatFloat(v.output[1], 'f', 8, 64),
-					strconv.FormatFloat(v.output[2], 'f', 3, 64),
-					strconv.FormatFloat(v.output[3], 'f', 8, 64)}
-				alignments = append(alignments, alignment)
+//CompareRefStats takes an alignment map, a sequence map and the reference slice and returns a map with the ref_header
+//as key and a RefStats struct as value.  Abundances are the mean count for a read (across replicates if individual
+//counts were loaded) and are NOT split by the number of times a read aligns to all reference sequences.
+func CompareRefStats(alignmentMap map[string]map[string][]int, seqMap map[string]interface{},
+	refSlice []*HeaderRef) map[string]*RefStats {
+	refStatsMap := make(map[string]*RefStats)
+	for _, ref := range refSlice {
+		alignment, ok := alignmentMap[ref.Header]
+		if !ok {
+			continue
+		}
+		refLen := len(ref.Seq)
+		singleRefStats := &RefStats{RefLen: refLen, DistinctReads: len(alignment), LenDist: make(map[int]float64)}
+		fwdCovered := make([]int, refLen+1)
+		rvsCovered := make([]int, refLen+1)
+		var fwdCount float64
+		var totalCount float64
+		for srna, positions := range alignment {
+			count := readMeanCount(seqMap[srna])
+			for _, position := range positions {
+				switch {
+				case position > 0:
+					markCovered(fwdCovered, position, len(srna))
+					fwdCount += count
+				case position < 0:
+					markCovered(rvsCovered, 0-position, len(srna))
+				}
+				totalCount += count
+				singleRefStats.LenDist[len(srna)] += count
 			}
-		case countsOutput:
-			if firstLine {
-				alignment := []string{"Header"}
-				alignment = append(alignment, aFileOrder...)
-				alignment = append(alignment, bFileOrder...)
-				alignments = append(alignments, alignment)
-				firstLine = false
+		}
+		singleRefStats.FwdCoverage = coveredFraction(fwdCovered, refLen)
+		singleRefStats.RvsCoverage = coveredFraction(rvsCovered, refLen)
+		if totalCount > 0 {
+			singleRefStats.StrandBias = fwdCount / totalCount
+		}
+		refStatsMap[ref.Header] = singleRefStats
+	}
+	return refStatsMap
+}
+
+//Returns the mean count for a read, irrespective of whether a meanSe or individual counts were loaded
+func readMeanCount(counts interface{}) float64 {
+	switch v := counts.(type) {
+	case *meanSe:
+		return v.Mean
+	case *[]float64:
+		countsMean, _ := stats.Mean(*v)
+		return countsMean
+	}
+	return 0.0
+}
+
+//Marks the positions covered by a read (pos from 5' fwd, starting at 1) in a difference slice
+func markCovered(covered []int, pos int, readLen int) {
+	covered[pos-1]++
+	covered[pos-1+readLen]--
+}
+
+//Calculates the fraction of ref positions covered from a difference slice
+func coveredFraction(covered []int, refLen int) float64 {
+	if refLen == 0 {
+		return 0.0
+	}
+	depth := 0
+	positions := 0
+	for _, i := range covered[:refLen] {
+		depth += i
+		if depth > 0 {
+			positions++
+		}
+	}
+	return float64(positions) / float64(refLen)
+}
+
+//CompareToCsv writes the output to a csv file, with a row for every ref header, sorted by header.
+//No run manifest is written - see Manifest.
+func CompareToCsv(cdpAlignmentMap map[string]interface{}, nt int, outPrefix string, aFileOrder []string, bFileOrder []string) {
+	if err := CompareToFile(cdpAlignmentMap, nt, outPrefix, aFileOrder, bFileOrder, nil); err != nil {
+		fmt.Println("\nCan't write compare output: " + err.Error())
+		errorShutdown()
+	}
+}
+
+//CompareToFile writes the output to a file in the format set by opts (csv, tsv, jsonl or col - DefaultOutputOptions if
+//nil).  The file extension is set by the format.  The file is written to a temporary file which is renamed on
+//success, so a partial file is never left.
+func CompareToFile(cdpAlignmentMap map[string]interface{}, nt int, outPrefix string, aFileOrder []string,
+	bFileOrder []string, opts *OutputOptions) error {
+	if opts == nil {
+		opts = DefaultOutputOptions()
+	}
+	return writeFileAtomic(compareOutFile(nt, outPrefix, opts.fileExt()), func(w io.Writer) error {
+		return WriteCompare(w, cdpAlignmentMap, aFileOrder, bFileOrder, opts)
+	})
+}
+
+//WriteCompare writes the output to w in the format set by opts (DefaultOutputOptions if nil).
+func WriteCompare(w io.Writer, cdpAlignmentMap map[string]interface{}, aFileOrder []string, bFileOrder []string,
+	opts *OutputOptions) error {
+	return streamTable(w, opts, func(emit emitRow) error {
+		return compareRows(cdpAlignmentMap, aFileOrder, bFileOrder, emit)
+	})
+}
+
+//MirnaCompareToCsv writes the MirnaCompare output to a csv file, with the miRBase accession for each miRNA (from
+//MirnaAccessions) in the second column.
+func MirnaCompareToCsv(cdpAlignmentMap map[string]interface{}, accessions map[string]string, outPrefix string,
+	aFileOrder []string, bFileOrder []string) {
+	if err := MirnaCompareToFile(cdpAlignmentMap, accessions, outPrefix, aFileOrder, bFileOrder, nil); err != nil {
+		fmt.Println("\nCan't write miRNA compare output: " + err.Error())
+		errorShutdown()
+	}
+}
+
+//MirnaCompareToFile writes the MirnaCompare output, with the miRBase accession for each miRNA in the second column,
+//to a file in the format set by opts (DefaultOutputOptions if nil), as for CompareToFile.
+func MirnaCompareToFile(cdpAlignmentMap map[string]interface{}, accessions map[string]string, outPrefix string,
+	aFileOrder []string, bFileOrder []string, opts *OutputOptions) error {
+	if opts == nil {
+		opts = DefaultOutputOptions()
+	}
+	return writeFileAtomic(compareOutFile(0, outPrefix, opts.fileExt()), func(w io.Writer) error {
+		return streamTable(w, opts, func(emit emitRow) error {
+			var accessionColumns []string
+			var accessionRow []interface{}
+			emitAccession := func(columns []string, row []interface{}) error {
+				if accessionColumns == nil {
+					accessionColumns = append([]string{columns[0], "Accession"}, columns[1:]...)
+				}
+				accessionRow = append(append(accessionRow[:0], row[0], accessions[row[0].(string)]), row[1:]...)
+				return emit(accessionColumns, accessionRow)
 			}
-			alignment := []string{header}
-			pos := 0
-			for pos < len(v.output) {
-				alignment = append(alignment, strconv.FormatFloat(v.output[pos], 'f', 3, 64))
+			return compareRows(cdpAlignmentMap, aFileOrder, bFileOrder, emitAccession)
+		})
+	})
+}
 
-				pos++
+//CompareStatsToCsv writes the output to a csv file, with the RefStats for each set of sequences appended as extra
+//columns.
+func CompareStatsToCsv(cdpAlignmentMap map[string]interface{}, refStatsMap1 map[string]*RefStats,
+	refStatsMap2 map[string]*RefStats, nt int, outPrefix string, aFileOrder []string, bFileOrder []string) {
+	err := CompareStatsToFile(cdpAlignmentMap, refStatsMap1, refStatsMap2, nt, outPrefix, aFileOrder, bFileOrder, nil)
+	if err != nil {
+		fmt.Println("\nCan't write compare stats output: " + err.Error())
+		errorShutdown()
+	}
+}
+
+//CompareStatsToFile writes the output, with the RefStats for each set of sequences appended as extra columns, to a
+//file in the format set by opts (DefaultOutputOptions if nil), as for CompareToFile.
+func CompareStatsToFile(cdpAlignmentMap map[string]interface{}, refStatsMap1 map[string]*RefStats,
+	refStatsMap2 map[string]*RefStats, nt int, outPrefix string, aFileOrder []string, bFileOrder []string,
+	opts *OutputOptions) error {
+	if opts == nil {
+		opts = DefaultOutputOptions()
+	}
+	return writeFileAtomic(compareOutFile(nt, outPrefix, opts.fileExt()), func(w io.Writer) error {
+		return streamTable(w, opts, func(emit emitRow) error {
+			var statsColumns []string
+			emitStats := func(columns []string, row []interface{}) error {
+				if statsColumns == nil {
+					statsColumns = append(append([]string(nil), columns...), "Ref. length")
+					for _, set := range []string{"1", "2"} {
+						statsColumns = append(statsColumns, "Distinct reads "+set, "Fwd coverage "+set,
+							"Rvs coverage "+set, "Strand bias "+set, "Length dist. "+set)
+					}
+				}
+				header := row[0].(string)
+				refLen := 0
+				for _, refStatsMap := range []map[string]*RefStats{refStatsMap1, refStatsMap2} {
+					if singleRefStats, ok := refStatsMap[header]; ok {
+						refLen = singleRefStats.RefLen
+					}
+				}
+				row = append(row, refLen)
+				for _, refStatsMap := range []map[string]*RefStats{refStatsMap1, refStatsMap2} {
+					row = append(row, refStatsColumns(refStatsMap[header])...)
+				}
+				return emit(statsColumns, row)
 			}
-			alignments = append(alignments, alignment)
+			return compareRows(cdpAlignmentMap, aFileOrder, bFileOrder, emitStats)
+		})
+	})
+}
 
+//Generates the RefStats columns for a header
+func refStatsColumns(singleRefStats *RefStats) []interface{} {
+	if singleRefStats == nil {
+		return []interface{}{0, 0.0, 0.0, 0.0, ""}
+	}
+	var lens []int
+	for readLen := range singleRefStats.LenDist {
+		lens = append(lens, readLen)
+	}
+	sort.Ints(lens)
+	var lenDist []string
+	for _, readLen := range lens {
+		lenDist = append(lenDist, strconv.Itoa(readLen)+":"+
+			strconv.FormatFloat(singleRefStats.LenDist[readLen], 'f', 3, 64))
+	}
+	return []interface{}{singleRefStats.DistinctReads, singleRefStats.FwdCoverage, singleRefStats.RvsCoverage,
+		singleRefStats.StrandBias, strings.Join(lenDist, ";")}
+}
+
+//compareRows generates the rows for a compare map sorted by ref header, passing each to emit.  Counts are float64
+//and standard errors are stdErr.
+func compareRows(cdpAlignmentMap map[string]interface{}, aFileOrder []string, bFileOrder []string,
+	emit emitRow) error {
+	var headers []string
+	for header := range cdpAlignmentMap {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+
+	meanSeColumns := []string{"Header", "Mean count 1", "Std. err 1", "Mean count 2", "Std. err 2"}
+	countsColumns := append(append([]string{"Header"}, aFileOrder...), bFileOrder...)
+	var row []interface{}
+	for _, header := range headers {
+		var err error
+		switch v := cdpAlignmentMap[header].(type) {
+		case compMeanSeOutput:
+			row = append(row[:0], header, v.output[0], stdErr(v.output[1]), v.output[2], stdErr(v.output[3]))
+			err = emit(meanSeColumns, row)
+		case countsOutput:
+			row = append(row[:0], header)
+			for _, count := range v.output {
+				row = append(row, count)
+			}
+			err = emit(countsColumns, row)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	var outFile string
+	return nil
+}
+
+//Generates the compare output file name
+func compareOutFile(nt int, outPrefix string, ext string) string {
 	switch {
 	case nt > 0:
-		outFile = outPrefix + "_" + strconv.Itoa(nt) + ".csv"
+		return outPrefix + "_" + strconv.Itoa(nt) + ext
 	default:
-		outFile = outPrefix + "_miR.csv"
+		return outPrefix + "_miR" + ext
 	}
+}
 
+//writeCsv writes rows to a csv file, creating the save directory if required
+func writeCsv(rows [][]string, outFile string) {
+	err := writeFileAtomic(outFile, func(f io.Writer) error {
+		w := csv.NewWriter(f)
+		w.WriteAll(rows)
+		return w.Error()
+	})
+	if err != nil {
+		log.Fatalln("error writing csv:", err)
+	}
+}
+
+//createOutFile creates an output file, creating the save directory if required
+func createOutFile(outFile string) *os.File {
 	outDir := filepath.Dir(outFile)
-	if err := os.MkdirAll(outDir, os.ModePerm); err != nil { fmt.Println("Not creating directory "+ outDir) }
+	if err := os.MkdirAll(outDir, os.ModePerm); err != nil {
+		fmt.Println("Not creating directory " + outDir)
+	}
 	f, err := os.Create(outFile)
 	if err != nil {
-		fmt.Println("Can't create save directory/file "+ outFile)
+		fmt.Println("Can't create save directory/file " + outFile)
 		errorShutdown()
 	}
-	w := csv.NewWriter(f)
-	w.WriteAll(alignments)
-	if err := w.Error(); err != nil {
-		log.Fatalln("error writing csv:", err)
-	}
+	recordOutput(outFile)
+	return f
 }
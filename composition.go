@@ -0,0 +1,122 @@
+package scramPkg
+
+import (
+	"sort"
+)
+
+// ReadClass is a class of aligned reads by length, 5' nucleotide and strand
+type ReadClass struct {
+	Len       int
+	FivePrime string // FivePrime is the 5' nucleotide of the read (A, C, G or T)
+	Strand    string
+}
+
+// compositionNts are the 5' nucleotides reported by ReadComposition
+var compositionNts = []string{"A", "C", "G", "T"}
+
+// ReadComposition takes an alignment map (e.g. from MergeAlignments for reads of different lengths) and a sequence map,
+// and counts the reads aligned to each reference sequence by read length (minLen to maxLen), 5' nucleotide and strand.
+// Reads outside the length range, or with a 5' nucleotide other than A, C, G or T, are not counted.  If split is true,
+// read counts are split by the number of times a read aligns to all reference sequences.
+// It returns a map of ref_header:ReadClass:meanSe or individual counts, with zero counts for every class not observed.
+func ReadComposition(alignmentMap map[string]map[string][]int, seqMap map[string]interface{}, minLen int,
+	maxLen int, split bool) map[string]map[ReadClass]interface{} {
+	srnaAlignmentMap := calcTimesReadAligns(alignmentMap)
+	var template interface{}
+	for _, counts := range seqMap {
+		template = counts
+		break
+	}
+	compositionMap := make(map[string]map[ReadClass]interface{})
+	for header, alignment := range alignmentMap {
+		classAccs := make(map[ReadClass]*countsAccumulator)
+		for srna, positions := range alignment {
+			if len(srna) < minLen || len(srna) > maxLen {
+				continue
+			}
+			factor := 1.0
+			if split {
+				factor = 1.0 / float64(srnaAlignmentMap[srna])
+			}
+			for _, position := range positions {
+				class := ReadClass{len(srna), srna[:1], "+"}
+				if position < 0 {
+					class.Strand = "-"
+				}
+				if _, ok := classAccs[class]; !ok {
+					classAccs[class] = &countsAccumulator{}
+				}
+				classAccs[class].add(seqMap[srna], factor)
+			}
+		}
+		headerComposition := make(map[ReadClass]interface{})
+		for readLen := minLen; readLen <= maxLen; readLen++ {
+			for _, nt := range compositionNts {
+				for _, strand := range []string{"+", "-"} {
+					class := ReadClass{readLen, nt, strand}
+					acc, ok := classAccs[class]
+					if !ok {
+						acc = &countsAccumulator{}
+					}
+					headerComposition[class] = acc.resultLike(template)
+				}
+			}
+		}
+		compositionMap[header] = headerComposition
+	}
+	return compositionMap
+}
+
+// ReadCompositionToCsv writes the read composition table for each reference sequence to a csv file, with a row for
+// each read length, 5' nucleotide and strand.
+func ReadCompositionToCsv(compositionMap map[string]map[ReadClass]interface{}, outPrefix string,
+	fileOrder []string) {
+	var headers []string
+	for header := range compositionMap {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+	writeTable(outPrefix+"_composition.csv", nil, func(emit emitRow) error {
+		return compositionRows(compositionMap, headers, fileOrder, emit)
+	})
+}
+
+// compositionRows generates the read composition rows for each header, passing each to emit
+func compositionRows(compositionMap map[string]map[ReadClass]interface{}, headers []string, fileOrder []string,
+	emit emitRow) error {
+	meanSeColumns := []string{"Header", "Length", "5' nt", "Strand", "Count", "Std. Err"}
+	countsColumns := append([]string{"Header", "Length", "5' nt", "Strand"}, fileOrder...)
+	var row []interface{}
+	for _, header := range headers {
+		var classes []ReadClass
+		for class := range compositionMap[header] {
+			classes = append(classes, class)
+		}
+		sort.Slice(classes, func(i, j int) bool {
+			switch {
+			case classes[i].Len != classes[j].Len:
+				return classes[i].Len < classes[j].Len
+			case classes[i].FivePrime != classes[j].FivePrime:
+				return classes[i].FivePrime < classes[j].FivePrime
+			}
+			return classes[i].Strand < classes[j].Strand
+		})
+		for _, class := range classes {
+			row = append(row[:0], header, class.Len, class.FivePrime, class.Strand)
+			var err error
+			switch v := compositionMap[header][class].(type) {
+			case meanSe:
+				err = emit(meanSeColumns, append(row, v.Mean, stdErr(v.Se)))
+			case []float64:
+				for _, count := range v {
+					row = append(row, count)
+				}
+				err = emit(countsColumns, row)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package scramPkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Config is a scram run configuration, covering read loading, alignment, count splitting and output.  It can be
+// loaded from a JSON file with LoadConfig.  Keys match the scram command flags, and are the same in the YAML and TOML
+// config files read by the scram command.
+type Config struct {
+	// Loading
+	ReadFileSet1 []string `json:"readFileSet1" yaml:"readFileSet1" toml:"readFileSet1"`
+	ReadFileSet2 []string `json:"readFileSet2,omitempty" yaml:"readFileSet2,omitempty" toml:"readFileSet2,omitempty"`
+	FileType     string   `json:"fileType" yaml:"fileType" toml:"fileType"` // FileType is cfa, clean, fa or fq
+	Adapter      string   `json:"adapter" yaml:"adapter" toml:"adapter"`    // Adapter is the 3' adapter ("" for none)
+	MinLen       int      `json:"minLen" yaml:"minLen" toml:"minLen"`
+	MaxLen       int      `json:"maxLen" yaml:"maxLen" toml:"maxLen"`
+	MinCount     float64  `json:"minCount" yaml:"minCount" toml:"minCount"`
+	NoNorm       bool     `json:"noNorm" yaml:"noNorm" toml:"noNorm"`
+	Indv         bool     `json:"indv" yaml:"indv" toml:"indv"` // Indv loads individual counts, not mean and se
+
+	// Alignment
+	AlignTo string `json:"alignTo" yaml:"alignTo" toml:"alignTo"` // AlignTo is the reference (or miRNA) FASTA file
+	Length  []int  `json:"length" yaml:"length" toml:"length"`    // Length are the read lengths to align
+	NoSplit bool   `json:"noSplit" yaml:"noSplit" toml:"noSplit"` // NoSplit doesn't split multi-aligning reads
+
+	// Output
+	OutFile string `json:"outFile" yaml:"outFile" toml:"outFile"` // OutFile is the output file prefix
+	Format  string `json:"format" yaml:"format" toml:"format"`    // Format is csv, tsv, jsonl or col
+	Gzip    bool   `json:"gzip" yaml:"gzip" toml:"gzip"`
+}
+
+// DefaultConfig returns the default run configuration.  Read files, the reference, lengths and output prefix must be
+// set.
+func DefaultConfig() *Config {
+	return &Config{FileType: "cfa", MinLen: 18, MaxLen: 32, MinCount: 1.0, Format: "csv"}
+}
+
+// LoadConfig loads a run configuration from a JSON file.  Options not in the file take their default values, and
+// unknown options are an error.  The configuration is not validated.  (The scram command also reads YAML and TOML
+// config files.)
+func LoadConfig(configFile string) (*Config, error) {
+	f, err := os.Open(configFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config := DefaultConfig()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("can't load config file %s: %v", configFile, err)
+	}
+	return config, nil
+}
+
+// Validate checks the run configuration, returning an error listing every problem found, or nil
+func (config *Config) Validate() error {
+	var problems []string
+	addProblem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+	if len(config.ReadFileSet1) == 0 {
+		addProblem("readFileSet1 is required")
+	}
+	for _, readFile := range append(append([]string(nil), config.ReadFileSet1...), config.ReadFileSet2...) {
+		if _, err := os.Stat(readFile); err != nil {
+			addProblem("read file %s can't be read: %v", readFile, err)
+		}
+	}
+	switch config.FileType {
+	case "cfa", "clean", "fa", "fq":
+	default:
+		addProblem("fileType must be cfa, clean, fa or fq, not %q", config.FileType)
+	}
+	adapter := strings.ToUpper(config.Adapter)
+	if adapter != "" && adapter != "NIL" && strings.Trim(adapter, "ACGTN") != "" {
+		addProblem("adapter %q is not a DNA sequence", config.Adapter)
+	}
+	if config.MinLen < 1 {
+		addProblem("minLen (%d) must be at least 1", config.MinLen)
+	}
+	if config.MinLen > config.MaxLen {
+		addProblem("minLen (%d) is greater than maxLen (%d)", config.MinLen, config.MaxLen)
+	}
+	if config.MinCount < 0 {
+		addProblem("minCount (%g) must not be negative", config.MinCount)
+	}
+	if config.AlignTo == "" {
+		addProblem("alignTo is required")
+	} else if _, err := os.Stat(config.AlignTo); err != nil {
+		addProblem("alignTo file %s can't be read: %v", config.AlignTo, err)
+	}
+	for _, nt := range config.Length {
+		if nt < config.MinLen || nt > config.MaxLen {
+			addProblem("length %d is outside minLen to maxLen (%d-%d), so no reads of that length are loaded", nt,
+				config.MinLen, config.MaxLen)
+		}
+	}
+	if config.OutFile == "" {
+		addProblem("outFile is required")
+	}
+	if _, ok := map[string]bool{"csv": true, "tsv": true, "jsonl": true, "col": true}[config.Format]; !ok {
+		addProblem("format must be csv, tsv, jsonl or col, not %q", config.Format)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+}
+
+// SeqLoad loads a set of read files with the loading options in the configuration.
+// It returns the sequence map (meanSe or individual counts) and the file order.
+func (config *Config) SeqLoad(readFiles []string) (map[string]interface{}, []string) {
+	adapter := config.Adapter
+	if adapter == "" {
+		adapter = "nil"
+	}
+	if config.Indv {
+		return IndvSeqLoad(readFiles, config.FileType, adapter, config.MinLen, config.MaxLen, config.MinCount,
+			config.NoNorm)
+	}
+	return SeqLoad(readFiles, config.FileType, adapter, config.MinLen, config.MaxLen, config.MinCount,
+		config.NoNorm), readFiles
+}
+
+// OutputOptions returns the output options for the configuration
+func (config *Config) OutputOptions() *OutputOptions {
+	opts := DefaultOutputOptions()
+	opts.Format = config.Format
+	opts.Gzip = config.Gzip
+	return opts
+}
+
+// Save writes the configuration to a JSON file
+func (config *Config) Save(configFile string) error {
+	return writeFileAtomic(configFile, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(config)
+	})
+}
+
+// Record writes the configuration to outFile_config.json, so the run can be reproduced
+func (config *Config) Record() error {
+	return config.Save(config.OutFile + "_config.json")
+}
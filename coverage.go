@@ -0,0 +1,247 @@
+package scramPkg
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/montanaflynn/stats"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+)
+
+// CoverageProfile is a struct comprising the per-position read depth for the sense (Fwd) and antisense (Rvs) strands
+// of a single reference sequence.  Depths are indexed [column][position - 1].  If MeanSe is true, column 0 is the mean
+// depth and column 1 its standard error; otherwise there is one column per replicate.
+type CoverageProfile struct {
+	RefLen int
+	MeanSe bool
+	Fwd    [][]float64
+	Rvs    [][]float64
+}
+
+// ProfileCoverage takes a profile alignments map (from ProfileSplit or ProfileNoSplit) and the reference slice as an
+// input.  It returns a map with the ref header as key and a CoverageProfile as value.  Counts are split (or not) as
+// they were in the profile alignments map.  Standard errors of overlapping reads are combined as for
+// CompareNoSplitCounts.
+func ProfileCoverage(profileAlignmentsMap map[string]interface{}, refSlice []*HeaderRef) map[string]*CoverageProfile {
+	coverageMap := make(map[string]*CoverageProfile)
+	for _, ref := range refSlice {
+		alignments, ok := profileAlignmentsMap[ref.Header]
+		if !ok {
+			continue
+		}
+		refLen := len(ref.Seq)
+		var cov *CoverageProfile
+		for _, alignment := range *alignments.(*singleAlignments) {
+			if cov == nil {
+				cov = newCoverageProfile(alignment.Alignments, refLen)
+			}
+			depth := cov.Fwd
+			if alignment.Strand == "-" {
+				depth = cov.Rvs
+			}
+			end := alignment.Pos - 1 + len(alignment.Seq)
+			if end > refLen {
+				end = refLen
+			}
+			for pos := alignment.Pos - 1; pos < end; pos++ {
+				switch v := alignment.Alignments.(type) {
+				case *meanSe:
+					depth[0][pos] += v.Mean
+					depth[1][pos] += v.Se * v.Se
+				case *[]float64:
+					for col, count := range *v {
+						depth[col][pos] += count
+					}
+				}
+			}
+		}
+		if cov == nil {
+			continue
+		}
+		if cov.MeanSe {
+			for _, depth := range [][]float64{cov.Fwd[1], cov.Rvs[1]} {
+				for pos, errSq := range depth {
+					depth[pos] = math.Sqrt(errSq)
+				}
+			}
+		}
+		coverageMap[ref.Header] = cov
+	}
+	return coverageMap
+}
+
+// Generates an empty CoverageProfile with columns matching the type of a single alignment count
+func newCoverageProfile(counts interface{}, refLen int) *CoverageProfile {
+	cols := 2
+	meanSeCols := true
+	if v, ok := counts.(*[]float64); ok {
+		cols = len(*v)
+		meanSeCols = false
+	}
+	cov := &CoverageProfile{RefLen: refLen, MeanSe: meanSeCols}
+	for col := 0; col < cols; col++ {
+		cov.Fwd = append(cov.Fwd, make([]float64, refLen))
+		cov.Rvs = append(cov.Rvs, make([]float64, refLen))
+	}
+	return cov
+}
+
+// CoverageMeanSe converts a coverage map with individual replicate depths to one with the mean depth and standard
+// error at each position.  Profiles that are already mean/se are returned unchanged.
+func CoverageMeanSe(coverageMap map[string]*CoverageProfile) map[string]*CoverageProfile {
+	meanSeMap := make(map[string]*CoverageProfile)
+	for header, cov := range coverageMap {
+		if cov.MeanSe {
+			meanSeMap[header] = cov
+			continue
+		}
+		meanSeCov := &CoverageProfile{RefLen: cov.RefLen, MeanSe: true}
+		meanSeCov.Fwd = replicateMeanSe(cov.Fwd, cov.RefLen)
+		meanSeCov.Rvs = replicateMeanSe(cov.Rvs, cov.RefLen)
+		meanSeMap[header] = meanSeCov
+	}
+	return meanSeMap
+}
+
+// Calculates the mean and standard error at each position for replicate depths
+func replicateMeanSe(depths [][]float64, refLen int) [][]float64 {
+	means := make([]float64, refLen)
+	ses := make([]float64, refLen)
+	sqrt := math.Sqrt(float64(len(depths)))
+	counts := make([]float64, len(depths))
+	for pos := 0; pos < refLen; pos++ {
+		for col := range depths {
+			counts[col] = depths[col][pos]
+		}
+		means[pos], _ = stats.Mean(counts)
+		if len(depths) > 1 {
+			countsStdDev, _ := stats.StandardDeviationSample(counts)
+			ses[pos] = countsStdDev / sqrt
+		}
+	}
+	return [][]float64{means, ses}
+}
+
+// depth returns the depth to report in a single value track (bedGraph/WIG) for a position.  This is the mean depth,
+// or the mean of the replicate depths.
+func (cov *CoverageProfile) depth(strandDepths [][]float64, pos int) float64 {
+	if cov.MeanSe {
+		return strandDepths[0][pos]
+	}
+	var total float64
+	for col := range strandDepths {
+		total += strandDepths[col][pos]
+	}
+	return total / float64(len(strandDepths))
+}
+
+// CoverageToCsv writes the per-position depth for each reference sequence to a csv file.
+func CoverageToCsv(coverageMap map[string]*CoverageProfile, refSlice []*HeaderRef, nt int, outPrefix string,
+	fileOrder []string) {
+	writeTable(outPrefix+"_"+strconv.Itoa(nt)+"_coverage.csv", nil, func(emit emitRow) error {
+		meanSeColumns := []string{"Header", "Position", "Fwd depth", "Fwd std. err", "Rvs depth", "Rvs std. err"}
+		countsColumns := []string{"Header", "Position"}
+		for _, strand := range []string{"Fwd ", "Rvs "} {
+			for _, file := range fileOrder {
+				countsColumns = append(countsColumns, strand+file)
+			}
+		}
+		var row []interface{}
+		for _, ref := range refSlice {
+			cov, ok := coverageMap[ref.Header]
+			if !ok {
+				continue
+			}
+			columns := countsColumns
+			if cov.MeanSe {
+				columns = meanSeColumns
+			}
+			for pos := 0; pos < cov.RefLen; pos++ {
+				row = append(row[:0], ref.Header, pos+1)
+				for _, strandDepths := range [][][]float64{cov.Fwd, cov.Rvs} {
+					for col := range strandDepths {
+						if cov.MeanSe && col == 1 {
+							row = append(row, stdErr(strandDepths[col][pos]))
+						} else {
+							row = append(row, strandDepths[col][pos])
+						}
+					}
+				}
+				if err := emit(columns, row); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// CoverageToBedGraph writes the depth for each reference sequence to a pair of bedGraph files (fwd and rvs strands).
+// Consecutive positions with the same depth are merged and zero depth intervals are omitted.
+func CoverageToBedGraph(coverageMap map[string]*CoverageProfile, refSlice []*HeaderRef, nt int, outPrefix string) {
+	for _, strand := range []string{"fwd", "rvs"} {
+		outFile := outPrefix + "_" + strconv.Itoa(nt) + "_" + strand + ".bedgraph"
+		err := writeFileAtomic(outFile, func(f io.Writer) error {
+			w := bufio.NewWriter(f)
+			fmt.Fprintf(w, "track type=bedGraph name=\"%s_%d_%s\"\n", filepath.Base(outPrefix), nt, strand)
+			for _, ref := range refSlice {
+				cov, ok := coverageMap[ref.Header]
+				if !ok {
+					continue
+				}
+				strandDepths := cov.Fwd
+				if strand == "rvs" {
+					strandDepths = cov.Rvs
+				}
+				start := 0
+				for pos := 1; pos <= cov.RefLen; pos++ {
+					if pos < cov.RefLen && cov.depth(strandDepths, pos) == cov.depth(strandDepths, start) {
+						continue
+					}
+					if depth := cov.depth(strandDepths, start); depth != 0 {
+						fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", ref.Header, start, pos,
+							strconv.FormatFloat(depth, 'f', 3, 64))
+					}
+					start = pos
+				}
+			}
+			return w.Flush()
+		})
+		if err != nil {
+			fmt.Println("\nCan't write " + outFile + ": " + err.Error())
+			errorShutdown()
+		}
+	}
+}
+
+// CoverageToWig writes the depth for each reference sequence to a pair of fixedStep WIG files (fwd and rvs strands).
+func CoverageToWig(coverageMap map[string]*CoverageProfile, refSlice []*HeaderRef, nt int, outPrefix string) {
+	for _, strand := range []string{"fwd", "rvs"} {
+		outFile := outPrefix + "_" + strconv.Itoa(nt) + "_" + strand + ".wig"
+		err := writeFileAtomic(outFile, func(f io.Writer) error {
+			w := bufio.NewWriter(f)
+			fmt.Fprintf(w, "track type=wiggle_0 name=\"%s_%d_%s\"\n", filepath.Base(outPrefix), nt, strand)
+			for _, ref := range refSlice {
+				cov, ok := coverageMap[ref.Header]
+				if !ok {
+					continue
+				}
+				strandDepths := cov.Fwd
+				if strand == "rvs" {
+					strandDepths = cov.Rvs
+				}
+				fmt.Fprintf(w, "fixedStep chrom=%s start=1 step=1\n", ref.Header)
+				for pos := 0; pos < cov.RefLen; pos++ {
+					fmt.Fprintln(w, strconv.FormatFloat(cov.depth(strandDepths, pos), 'f', 3, 64))
+				}
+			}
+			return w.Flush()
+		})
+		if err != nil {
+			fmt.Println("\nCan't write " + outFile + ": " + err.Error())
+			errorShutdown()
+		}
+	}
+}
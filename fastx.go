@@ -11,6 +11,8 @@ import (
 	"math"
 	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -135,6 +137,7 @@ func loadCfaFile(fileNames chan string, srnaMaps chan map[string]map[string]floa
 	}
 	finalMap := map[string]map[string]float64{fileName: srnaMap}
 	srnaMaps <- finalMap
+	recordLibrary(fileName, totalCount)
 
 	fmt.Println(fileName + " - " + humanize.Comma(int64(totalCount)) + " reads processed")
 	wg.Done()
@@ -188,6 +191,7 @@ func loadFastx(fileNames chan string, firstChar []byte, adapter string, srnaMaps
 	}
 	final_map := map[string]map[string]float64{fileName: srnaMap}
 	srnaMaps <- final_map
+	recordLibrary(fileName, totalCount)
 	fmt.Println(fileName + " - " + humanize.Comma(int64(totalCount)) + " reads processed")
 	wg.Done()
 }
@@ -338,19 +342,139 @@ func calcMeanSe(seq_map_all_counts map[string]interface{}, no_of_files int) map[
 
 // HeaderRef is a struct comprising a reference sequence header, seques and reverse complement
 type HeaderRef struct {
-	Header     string
-	Seq        string
-	ReverseSeq string
+	Header      string // Header is the key for the reference in all maps - the same as ID
+	Seq         string
+	ReverseSeq  string
+	ID          string // ID is the first word of the FASTA header line
+	Description string // Description is the rest of the FASTA header line
 }
 
-// RefLoad loads a reference sequence DNA file (FASTA format).
+// Generates a HeaderRef from a FASTA header line (without the >) and sequence
+func newHeaderRef(headerLine string, seq string) *HeaderRef {
+	id, description := splitHeader(headerLine)
+	return &HeaderRef{id, seq, reverseComplement(seq), id, description}
+}
+
+// Splits a FASTA header line into its ID (first word) and description (the rest)
+func splitHeader(headerLine string) (string, string) {
+	headerLine = strings.TrimSpace(headerLine)
+	if i := strings.IndexAny(headerLine, " \t"); i >= 0 {
+		return headerLine[:i], strings.TrimSpace(headerLine[i+1:])
+	}
+	return headerLine, ""
+}
+
+// RefDescriptions returns a map of reference IDs : descriptions, for OutputOptions.Descriptions
+func RefDescriptions(refSlice []*HeaderRef) map[string]string {
+	descriptions := make(map[string]string)
+	for _, ref := range refSlice {
+		descriptions[ref.Header] = ref.Description
+	}
+	return descriptions
+}
+
+// RefOptions are the options for loading reference sequences with RefLoadWithOptions.  If no headers, pattern or
+// regions are set, all reference sequences are loaded.
+type RefOptions struct {
+	Headers    []string // Headers are the reference headers (full header or first word) to load
+	Pattern    string   // Pattern is a regular expression - reference headers that match it are loaded
+	Regions    []string // Regions are the regions (header:start-end, 1-based inclusive) to load
+	RegionFile string   // RegionFile is a BED file of regions to load
+	Duplicates string   // Duplicates is the duplicate header policy - "suffix" (the default), "merge" or "error"
+	// Validation are the policies for sequence issues (see ValidateRefs).  Sequences are not validated if nil.
+	Validation *ValidationOptions
+}
+
+// refRegion is a region of a reference sequence (1-based, inclusive)
+type refRegion struct {
+	name  string
+	start int
+	end   int
+}
+
+// RefLoad loads a reference sequence DNA file (FASTA format).  The first word of each header line is the reference ID,
+// which is used as the header (key) for the reference, and the rest of the line is its description.
 // It returns a slice of HeaderRef structs (individual reference header, sequence and reverse complement).
 func RefLoad(refFile string) []*HeaderRef {
-	var totalLength int
+	return RefLoadWithOptions(refFile, nil)
+}
+
+// RefLoadWithOptions loads a reference sequence DNA file (FASTA format), keeping only the reference sequences selected
+// by header or pattern, and the regions, in opts.  Each region is loaded as a separate reference sequence with the
+// ID header:start-end, so alignment positions are reported in the region's own coordinates (starting at 1).
+// Sequences that are not selected are not held in memory.  Windows (CRLF) line endings are removed, with a warning, and
+// the sequences are then validated if opts.Validation is set.  Regions are extracted before validation, so a warning is
+// given if stripped characters shift the positions in a region.
+// It returns a slice of HeaderRef structs (individual reference header, sequence and reverse complement).
+func RefLoadWithOptions(refFile string, opts *RefOptions) []*HeaderRef {
+	refSlice, _ := RefLoadWithReport(refFile, opts)
+	return refSlice
+}
+
+// RefLoadWithReport loads a reference sequence DNA file as RefLoadWithOptions does, and also returns the issues found
+// if opts.Validation is set (including Windows line endings), for RefIssuesToCsv.
+func RefLoadWithReport(refFile string, opts *RefOptions) ([]*HeaderRef, []*RefIssue) {
+	if opts == nil {
+		opts = &RefOptions{}
+	}
+	checkDuplicatePolicy(opts.Duplicates)
+	if opts.Validation != nil {
+		checkValidationOptions(opts.Validation)
+	}
+	selectAll := len(opts.Headers) == 0 && opts.Pattern == "" && len(opts.Regions) == 0 && opts.RegionFile == ""
+	selectHeaders := make(map[string]bool)
+	for _, header := range opts.Headers {
+		selectHeaders[header] = true
+	}
+	var pattern *regexp.Regexp
+	if opts.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(opts.Pattern); err != nil {
+			fmt.Println("\nBad reference header pattern " + opts.Pattern + ": " + err.Error())
+			errorShutdown()
+		}
+	}
+	regions := make(map[string][]refRegion)
+	for _, regionText := range opts.Regions {
+		region := parseRegion(regionText)
+		regions[region.name] = append(regions[region.name], region)
+	}
+	if opts.RegionFile != "" {
+		for _, region := range bedRegionLoad(opts.RegionFile) {
+			regions[region.name] = append(regions[region.name], region)
+		}
+	}
+	found := make(map[string]bool)
+	regionIDs := make(map[string]bool)
+
 	var refSlice []*HeaderRef
-	var singleHeaderRef *HeaderRef
 	var header string
+	var headerRegions []refRegion
+	keepHeader := false
 	var refSeq bytes.Buffer
+	// adds the whole sequence and/or its regions for the previous header to the refSlice
+	addRef := func() {
+		seq := refSeq.String()
+		if keepHeader {
+			refSlice = append(refSlice, newHeaderRef(header, seq))
+		}
+		for _, region := range headerRegions {
+			if region.start > len(seq) {
+				fmt.Println("Warning: region " + regionHeader(region) + " is beyond the end of the reference sequence")
+				continue
+			}
+			if region.end > len(seq) {
+				fmt.Println("Warning: region " + regionHeader(region) + " has been truncated to the end of the " +
+					"reference sequence")
+				region.end = len(seq)
+			}
+			regionSeq := seq[region.start-1 : region.end]
+			_, description := splitHeader(header)
+			regionIDs[regionHeader(region)] = true
+			refSlice = append(refSlice, newHeaderRef(regionHeader(region)+" "+description, regionSeq))
+		}
+	}
+
 	f, err := os.Open(refFile)
 	defer f.Close()
 	if err != nil {
@@ -358,31 +482,249 @@ func RefLoad(refFile string) []*HeaderRef {
 		errorShutdown()
 	}
 	scanner := bufio.NewScanner(f)
+	scanner.Split(scanLinesKeepCR)
+	firstHeader := true
+	crlfLines := 0
 	for scanner.Scan() {
 		fastaLine := scanner.Text()
+		if strings.HasSuffix(fastaLine, "\r") {
+			fastaLine = strings.TrimSuffix(fastaLine, "\r")
+			crlfLines++
+		}
 		switch {
 		case strings.HasPrefix(fastaLine, ">"):
-			seq := refSeq.String()
-			singleHeaderRef = &HeaderRef{header, seq, reverseComplement(seq)}
-			refSlice = append(refSlice, singleHeaderRef)
+			if !firstHeader {
+				addRef()
+			}
+			firstHeader = false
 			header = fastaLine[1:]
+			id, _ := splitHeader(header)
+			keepHeader = selectAll || selectHeaders[header] || selectHeaders[id] ||
+				(pattern != nil && pattern.MatchString(header))
+			headerRegions = regions[header]
+			if headerRegions == nil {
+				headerRegions = regions[id]
+			}
+			if keepHeader || headerRegions != nil {
+				found[header] = true
+				found[id] = true
+			}
 			refSeq.Reset()
-		case len(fastaLine) != 0:
+		case len(fastaLine) != 0 && (keepHeader || headerRegions != nil):
 			refSeq.WriteString(strings.ToUpper(fastaLine))
-			totalLength += len(fastaLine)
 		}
 	}
-	seq := refSeq.String()
-	singleHeaderRef = &HeaderRef{header, seq, reverseComplement(seq)}
-	refSlice = append(refSlice, singleHeaderRef)
-	refSlice = refSlice[1:]
+	if !firstHeader {
+		addRef()
+	}
+	if crlfLines > 0 && opts.Validation == nil {
+		fmt.Println("Warning: " + strconv.Itoa(crlfLines) + " line(s) of " + refFile + " have Windows (CRLF) line " +
+			"endings - these have been removed")
+	}
+	for _, header := range opts.Headers {
+		if !found[header] {
+			fmt.Println("Warning: reference header " + header + " not found")
+		}
+	}
+	for name := range regions {
+		if !found[name] {
+			fmt.Println("Warning: reference header " + name + " for region(s) not found")
+		}
+	}
 
+	var issues []*RefIssue
+	if opts.Validation != nil {
+		regionLengths := make(map[string]int)
+		for _, ref := range refSlice {
+			if regionIDs[ref.ID] {
+				regionLengths[ref.ID] = len(ref.Seq)
+			}
+		}
+		refSlice, issues = ValidateRefs(refSlice, opts.Validation)
+		if crlfLines > 0 {
+			issues = append([]*RefIssue{{refFile, "Windows (CRLF) line endings", crlfLines, "stripped"}}, issues...)
+		}
+		reportRefIssues(issues)
+		// regions are extracted before validation, so stripped characters shift the positions in a region
+		for _, ref := range refSlice {
+			if length, ok := regionLengths[ref.ID]; ok && length != len(ref.Seq) {
+				fmt.Println("Warning: " + strconv.Itoa(length-len(ref.Seq)) + " nt stripped from region " + ref.ID +
+					" - alignment positions are no longer offsets from the region start")
+			}
+		}
+	}
+	refSlice = resolveDuplicateRefs(refSlice, opts.Duplicates)
+
+	var totalLength int
+	for _, ref := range refSlice {
+		totalLength += len(ref.Seq)
+	}
 	fmt.Println("No. of reference sequences: ", len(refSlice))
 	fmt.Println("Combined length of reference sequences: " + humanize.Comma(int64(totalLength)) + " nt")
-	return refSlice
+	return refSlice, issues
+}
+
+// scanLinesKeepCR is bufio.ScanLines without removing a trailing \r, so Windows (CRLF) line endings can be counted
+func scanLinesKeepCR(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Checks a duplicate header policy is valid
+func checkDuplicatePolicy(policy string) {
+	if policy != "" && policy != "suffix" && policy != "merge" && policy != "error" {
+		fmt.Println("\nDuplicate header policy must be suffix, merge or error, not " + policy)
+		errorShutdown()
+	}
+}
+
+// resolveDuplicateRefs detects reference sequences with the same header and applies the duplicate header policy.  With
+// "suffix", the second and later records are renamed header_2, header_3, etc.  With "merge", the records are joined
+// into the first, separated by an N so that reads can't align across the join, and the position of each merged record
+// is reported.  With "error", scram exits.
+func resolveDuplicateRefs(refSlice []*HeaderRef, policy string) []*HeaderRef {
+	headerCounts := make(map[string]int)
+	for _, ref := range refSlice {
+		headerCounts[ref.Header]++
+	}
+	reportDuplicates(headerCounts, "reference", policy)
+
+	var resolved []*HeaderRef
+	var merged []string
+	seen := make(map[string]*HeaderRef)
+	occurrences := make(map[string]int)
+	for _, ref := range refSlice {
+		first, ok := seen[ref.Header]
+		switch {
+		case !ok:
+			seen[ref.Header] = ref
+			occurrences[ref.Header] = 1
+			resolved = append(resolved, ref)
+		case policy == "merge":
+			occurrences[ref.Header]++
+			merged = append(merged, "  "+ref.Header+" - record "+strconv.Itoa(occurrences[ref.Header])+" at "+
+				strconv.Itoa(len(first.Seq)+2)+"-"+strconv.Itoa(len(first.Seq)+1+len(ref.Seq)))
+			first.Seq += "N" + ref.Seq
+			first.ReverseSeq = reverseComplement(first.Seq)
+		default:
+			suffixed := uniqueHeader(ref.Header, occurrences, headerCounts)
+			ref.Header = suffixed
+			ref.ID = suffixed
+			seen[suffixed] = ref
+			resolved = append(resolved, ref)
+		}
+	}
+	if len(merged) > 0 {
+		fmt.Println("Warning: merged reference records are offset - alignment positions are in the merged sequence")
+		for _, line := range merged {
+			fmt.Println(line)
+		}
+	}
+	return resolved
+}
+
+// uniqueHeader returns the next header_n for a duplicate header that is not already in use
+func uniqueHeader(header string, occurrences map[string]int, headerCounts map[string]int) string {
+	for {
+		occurrences[header]++
+		suffixed := header + "_" + strconv.Itoa(occurrences[header])
+		if _, ok := headerCounts[suffixed]; !ok {
+			headerCounts[suffixed] = 1
+			return suffixed
+		}
+	}
+}
+
+// reportDuplicates prints a warning listing the duplicated headers (with a count > 1), and exits if the duplicate
+// header policy is "error"
+func reportDuplicates(headerCounts map[string]int, recordType string, policy string) {
+	var duplicates []string
+	for header, count := range headerCounts {
+		if count > 1 {
+			duplicates = append(duplicates, header)
+		}
+	}
+	if len(duplicates) == 0 {
+		return
+	}
+	sort.Strings(duplicates)
+	if policy == "" {
+		policy = "suffix"
+	}
+	fmt.Println("Warning: " + strconv.Itoa(len(duplicates)) + " duplicate " + recordType + " header(s) (policy: " +
+		policy + ")")
+	for _, header := range duplicates {
+		fmt.Println("  " + header + " - " + strconv.Itoa(headerCounts[header]) + " records")
+	}
+	if policy == "error" {
+		errorShutdown()
+	}
+}
+
+// Parses a region (header:start-end, 1-based inclusive)
+func parseRegion(regionText string) refRegion {
+	colon := strings.LastIndex(regionText, ":")
+	var start, end int
+	var startErr, endErr error = errors.New("no range"), nil
+	if colon > 0 {
+		startEnd := strings.SplitN(strings.Replace(regionText[colon+1:], ",", "", -1), "-", 2)
+		if len(startEnd) == 2 {
+			start, startErr = strconv.Atoi(startEnd[0])
+			end, endErr = strconv.Atoi(startEnd[1])
+		}
+	}
+	if startErr != nil || endErr != nil || start < 1 || end < start {
+		fmt.Println("\nBad region " + regionText + " - regions must be header:start-end")
+		errorShutdown()
+	}
+	return refRegion{regionText[:colon], start, end}
+}
+
+// Loads regions from a BED file (0-based start, end exclusive)
+func bedRegionLoad(bedFile string) []refRegion {
+	var regions []refRegion
+	f, err := os.Open(bedFile)
+	if err != nil {
+		fmt.Println("Problem opening BED file " + bedFile)
+		errorShutdown()
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "track" || fields[0] == "browser" || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			fmt.Println("BED file format problem - line " + strconv.Itoa(lineNo) + " of " + bedFile +
+				" has fewer than 3 columns")
+			errorShutdown()
+		}
+		start, startErr := strconv.Atoi(fields[1])
+		end, endErr := strconv.Atoi(fields[2])
+		if startErr != nil || endErr != nil || start < 0 || end <= start {
+			fmt.Println("BED file format problem - bad coordinates on line " + strconv.Itoa(lineNo) + " of " +
+				bedFile)
+			errorShutdown()
+		}
+		regions = append(regions, refRegion{fields[0], start + 1, end})
+	}
+	return regions
+}
+
+// Generates the header for a region
+func regionHeader(region refRegion) string {
+	return region.name + ":" + strconv.Itoa(region.start) + "-" + strconv.Itoa(region.end)
 }
 
-// Reverse complements a DNA sequence
+// Reverse complements a DNA sequence, including IUPAC ambiguity codes.  Any other character is complemented to N.
 func reverseComplement(seq string) string {
 	complement := map[rune]rune{
 		'A': 'T',
@@ -390,11 +732,25 @@ func reverseComplement(seq string) string {
 		'G': 'C',
 		'T': 'A',
 		'N': 'N',
+		'R': 'Y',
+		'Y': 'R',
+		'S': 'S',
+		'W': 'W',
+		'K': 'M',
+		'M': 'K',
+		'B': 'V',
+		'V': 'B',
+		'D': 'H',
+		'H': 'D',
 	}
 	runes := []rune(seq)
 	var result bytes.Buffer
 	for i := len(runes) - 1; i >= 0; i-- {
-		result.WriteRune(complement[runes[i]])
+		if comp, ok := complement[runes[i]]; ok {
+			result.WriteRune(comp)
+		} else {
+			result.WriteRune('N')
+		}
 	}
 	return result.String()
 }
@@ -402,13 +758,41 @@ func reverseComplement(seq string) string {
 // a struct for mature miRNAs that are present more than once in a reference set (i.e. same mature seq / dif precursor
 // seq.
 type mirnaSeqDup struct {
-	seq string
-	dup float64
+	seq         string
+	dup         float64
+	accession   string
+	description string
+}
+
+// MirOptions are the options for loading mature miRNAs with MirLoadWithOptions.
+type MirOptions struct {
+	Prefixes  []string // Prefixes are the species prefixes to load (e.g. "ath" for ath-miR156a).  All if empty.
+	Organisms []string // Organisms are the organism names to load (e.g. "Arabidopsis thaliana").  All if empty.
+	AliasFile string   // AliasFile is a miRBase aliases.txt file (accession, then ; separated names)
+	// Duplicates is the duplicate header policy - "suffix" (the default), "merge" or "error".  With "merge", records
+	// with the same header and sequence are loaded once; those with different sequences are suffixed.
+	Duplicates string
 }
 
 // MirLoad loads mature miRNA sequences from a mirna FASTA file (i.e. generated from miRBase)
-// It returns a map of headers : mirna sequences (converted to DNA)
+// It returns a map of IDs (the first word of each header) : mirna sequences (converted to DNA)
 func MirLoad(mirFile string) map[string]*mirnaSeqDup {
+	return MirLoadWithOptions(mirFile, nil)
+}
+
+// MirLoadWithOptions loads mature miRNA sequences from a mirna FASTA file (i.e. generated from miRBase), keeping only
+// those that match the species prefixes or organisms in opts.  Dup values are calculated after filtering.  The miRBase
+// accession (MIMAT...) for each miRNA is taken from its header or, if not present, looked up by name in the alias file.
+// It returns a map of IDs (the first word of each header) : mirna sequences (converted to DNA)
+func MirLoadWithOptions(mirFile string, opts *MirOptions) map[string]*mirnaSeqDup {
+	if opts == nil {
+		opts = &MirOptions{}
+	}
+	checkDuplicatePolicy(opts.Duplicates)
+	var aliases map[string]string
+	if opts.AliasFile != "" {
+		aliases = AliasLoad(opts.AliasFile)
+	}
 	var header string
 	mirnaMap := make(map[string]*mirnaSeqDup)
 	mirnaDups := make(map[string]float64)
@@ -418,19 +802,44 @@ func MirLoad(mirFile string) map[string]*mirnaSeqDup {
 		fmt.Println("Problem opening fasta reference file " + mirFile)
 		errorShutdown()
 	}
+	type mirnaRecord struct {
+		header string
+		seq    string
+	}
+	var records []mirnaRecord
 	scanner := bufio.NewScanner(f)
+	keep := false
 	for scanner.Scan() {
 		fastaLine := scanner.Text()
 		switch {
 		case strings.HasPrefix(fastaLine, ">"):
 			header = fastaLine[1:]
-		case len(fastaLine) != 0:
-			seq := strings.Replace(strings.ToUpper(fastaLine), "U", "T", -1)
-			mirnaMap[header] = &mirnaSeqDup{seq, 0.0}
-			mirnaDups[seq] += 1.0
+			keep = mirnaSpeciesMatch(header, opts)
+		case len(fastaLine) != 0 && keep:
+			records = append(records, mirnaRecord{header, strings.Replace(strings.ToUpper(fastaLine), "U", "T", -1)})
 		}
 
 	}
+	// all IDs are counted before suffixing, so that a suffixed ID doesn't clash with a later record
+	headerCounts := make(map[string]int)
+	for _, record := range records {
+		id, _ := splitHeader(record.header)
+		headerCounts[id]++
+	}
+	occurrences := make(map[string]int)
+	for _, record := range records {
+		id, description := splitHeader(record.header)
+		if existing, ok := mirnaMap[id]; ok {
+			if opts.Duplicates == "merge" && existing.seq == record.seq {
+				continue
+			}
+			id = uniqueHeader(id, occurrences, headerCounts)
+		}
+		occurrences[id] = 1
+		mirnaMap[id] = &mirnaSeqDup{record.seq, 0.0, mirnaAccession(record.header, aliases), description}
+		mirnaDups[record.seq] += 1.0
+	}
+	reportDuplicates(headerCounts, "miRNA", opts.Duplicates)
 	for mirnaHeader, seqDup := range mirnaMap {
 		if dup, ok := mirnaDups[seqDup.seq]; ok {
 			mirnaMap[mirnaHeader].dup = dup
@@ -438,3 +847,77 @@ func MirLoad(mirFile string) map[string]*mirnaSeqDup {
 	}
 	return mirnaMap
 }
+
+// Checks if a miRNA header matches the species prefixes or organisms to load
+func mirnaSpeciesMatch(header string, opts *MirOptions) bool {
+	if len(opts.Prefixes) == 0 && len(opts.Organisms) == 0 {
+		return true
+	}
+	name, _ := splitHeader(header)
+	for _, prefix := range opts.Prefixes {
+		if strings.HasPrefix(name, prefix+"-") {
+			return true
+		}
+	}
+	for _, organism := range opts.Organisms {
+		if strings.Contains(" "+header+" ", " "+organism+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// Gets the miRBase accession for a miRNA from its header, or from the aliases by name
+func mirnaAccession(header string, aliases map[string]string) string {
+	headerFields := strings.Fields(header)
+	if len(headerFields) > 1 && strings.HasPrefix(headerFields[1], "MIMAT") {
+		return headerFields[1]
+	}
+	if len(headerFields) > 0 {
+		return aliases[headerFields[0]]
+	}
+	return ""
+}
+
+// AliasLoad loads a miRBase aliases.txt file (accession, tab, then ; separated current and previous names).
+// It returns a map of names : accessions
+func AliasLoad(aliasFile string) map[string]string {
+	aliases := make(map[string]string)
+	f, err := os.Open(aliasFile)
+	if err != nil {
+		fmt.Println("Problem opening alias file " + aliasFile)
+		errorShutdown()
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		aliasLine := strings.Fields(scanner.Text())
+		if len(aliasLine) < 2 {
+			continue
+		}
+		for _, name := range strings.Split(aliasLine[1], ";") {
+			if name != "" {
+				aliases[name] = aliasLine[0]
+			}
+		}
+	}
+	return aliases
+}
+
+// MirnaDescriptions returns a map of miRNA IDs : descriptions for a mirna map, for OutputOptions.Descriptions
+func MirnaDescriptions(mirnaMap map[string]*mirnaSeqDup) map[string]string {
+	descriptions := make(map[string]string)
+	for mirnaHeader, seqDup := range mirnaMap {
+		descriptions[mirnaHeader] = seqDup.description
+	}
+	return descriptions
+}
+
+// MirnaAccessions returns a map of miRNA headers : miRBase accessions for a mirna map (from MirLoadWithOptions)
+func MirnaAccessions(mirnaMap map[string]*mirnaSeqDup) map[string]string {
+	accessions := make(map[string]string)
+	for mirnaHeader, seqDup := range mirnaMap {
+		accessions[mirnaHeader] = seqDup.accession
+	}
+	return accessions
+}
@@ -0,0 +1,10 @@
+module github.com/sfletc/scram2pkg
+
+go 1.21
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/dustin/go-humanize v1.1.0
+	github.com/montanaflynn/stats v0.12.7
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,296 @@
+package scramPkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HairpinLoad loads miRNA precursor (hairpin) sequences from a FASTA file (i.e. miRBase hairpin.fa), in which
+// sequences may span multiple lines.
+// It returns a map of IDs (the first word of each header) : hairpin sequences (converted to DNA), and a map of IDs :
+// descriptions (the rest of each header)
+func HairpinLoad(hairpinFile string) (map[string]string, map[string]string) {
+	hairpinMap := make(map[string]string)
+	descriptions := make(map[string]string)
+	var id string
+	var hairpinSeq bytes.Buffer
+	f, err := os.Open(hairpinFile)
+	if err != nil {
+		fmt.Println("Problem opening fasta hairpin file " + hairpinFile)
+		errorShutdown()
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fastaLine := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(fastaLine, ">"):
+			if id != "" {
+				hairpinMap[id] = hairpinSeq.String()
+			}
+			var description string
+			id, description = splitHeader(fastaLine[1:])
+			descriptions[id] = description
+			hairpinSeq.Reset()
+		case len(fastaLine) != 0:
+			hairpinSeq.WriteString(strings.Replace(strings.ToUpper(fastaLine), "U", "T", -1))
+		}
+	}
+	if id != "" {
+		hairpinMap[id] = hairpinSeq.String()
+	}
+	delete(descriptions, "")
+	return hairpinMap, descriptions
+}
+
+// Isomir is a struct comprising a read aligned to a hairpin and its variation relative to a mature miRNA
+type Isomir struct {
+	Seq           string
+	Mirna         string      // Mirna is the mature miRNA header
+	Hairpin       string      // Hairpin is the hairpin ID
+	Shift5        int         // Shift5 is the 5' end position relative to the mature miRNA (+ve is downstream)
+	Shift3        int         // Shift3 is the templated 3' end position relative to the mature miRNA (-ve is trimmed)
+	Addition      string      // Addition is the 3' non-templated addition
+	Substitutions []string    // Substitutions are internal mismatches (read position:hairpin nt>read nt)
+	Assignments   int         // Assignments is the no. of mature miRNAs the read is assigned to
+	Counts        interface{} // Counts is the *meanSe or *[]float64 for the read (NOT split)
+}
+
+// Class returns the isomiR class - canonical, or a combination of 5'shift, 3'trim, 3'extension, 3'NTA and
+// substitution
+func (iso *Isomir) Class() string {
+	var classes []string
+	if iso.Shift5 != 0 {
+		classes = append(classes, "5'shift")
+	}
+	switch {
+	case iso.Shift3 < 0:
+		classes = append(classes, "3'trim")
+	case iso.Shift3 > 0:
+		classes = append(classes, "3'extension")
+	}
+	if iso.Addition != "" {
+		classes = append(classes, "3'NTA")
+	}
+	if len(iso.Substitutions) > 0 {
+		classes = append(classes, "substitution")
+	}
+	if len(classes) == 0 {
+		return "canonical"
+	}
+	return strings.Join(classes, ";")
+}
+
+// matureSite is the location of a mature miRNA within a hairpin (0-based, end exclusive)
+type matureSite struct {
+	mirna string
+	start int
+	end   int
+}
+
+// hairpinHit is a position of a seed k-mer in a hairpin
+type hairpinHit struct {
+	hairpin string
+	pos     int
+}
+
+// isomirSeedLen is the k-mer length used to seed read alignments to hairpins
+const isomirSeedLen = 10
+
+// AlignIsomirs aligns reads of any length to the hairpins in the sense orientation and assigns them to the mature
+// miRNAs found in each hairpin.  Reads may have up to maxAddition nt of 3' non-templated addition and one internal
+// substitution, and are assigned to a mature miRNA if both templated ends are within maxShift nt of the mature ends.
+// A map of mirna_header:[isomiR,...] is returned, with the isomiRs sorted by read sequence.
+func AlignIsomirs(seqMap map[string]interface{}, mirnaMap map[string]*mirnaSeqDup, hairpinMap map[string]string,
+	maxShift int, maxAddition int) map[string][]*Isomir {
+	seedIndex := hairpinSeedIndex(hairpinMap)
+	sites := locateMatures(mirnaMap, hairpinMap, seedIndex)
+
+	isomirMap := make(map[string][]*Isomir)
+	for srna, counts := range seqMap {
+		readIsomirs := make(map[string]*Isomir)
+		for _, offset := range []int{0, isomirSeedLen} {
+			if offset+isomirSeedLen > len(srna) {
+				break
+			}
+			for _, hit := range seedIndex[srna[offset:offset+isomirSeedLen]] {
+				start := hit.pos - offset
+				if start < 0 {
+					continue
+				}
+				templLen, subs, ok := templatedAlignment(srna, hairpinMap[hit.hairpin][start:], maxAddition)
+				if !ok {
+					continue
+				}
+				for _, site := range sites[hit.hairpin] {
+					shift5 := start - site.start
+					shift3 := start + templLen - site.end
+					if _, ok := readIsomirs[site.mirna]; ok || shift5 < -maxShift || shift5 > maxShift ||
+						shift3 < -maxShift || shift3 > maxShift {
+						continue
+					}
+					readIsomirs[site.mirna] = &Isomir{Seq: srna, Mirna: site.mirna, Hairpin: hit.hairpin,
+						Shift5: shift5, Shift3: shift3, Addition: srna[templLen:], Substitutions: subs,
+						Counts: counts}
+				}
+			}
+		}
+		for mirnaHeader, iso := range readIsomirs {
+			iso.Assignments = len(readIsomirs)
+			isomirMap[mirnaHeader] = append(isomirMap[mirnaHeader], iso)
+		}
+	}
+	for _, isomirs := range isomirMap {
+		sort.Slice(isomirs, func(i, j int) bool { return isomirs[i].Seq < isomirs[j].Seq })
+	}
+	return isomirMap
+}
+
+// hairpinSeedIndex indexes the seed k-mer positions in each hairpin.  Hits for each seed are sorted by hairpin header
+// and position, so reads are aligned to hairpins in the same order each run.
+func hairpinSeedIndex(hairpinMap map[string]string) map[string][]hairpinHit {
+	seedIndex := make(map[string][]hairpinHit)
+	for hairpinHeader, hairpinSeq := range hairpinMap {
+		for pos := 0; pos+isomirSeedLen <= len(hairpinSeq); pos++ {
+			seed := hairpinSeq[pos : pos+isomirSeedLen]
+			seedIndex[seed] = append(seedIndex[seed], hairpinHit{hairpinHeader, pos})
+		}
+	}
+	for _, hits := range seedIndex {
+		sort.Slice(hits, func(i, j int) bool {
+			if hits[i].hairpin != hits[j].hairpin {
+				return hits[i].hairpin < hits[j].hairpin
+			}
+			return hits[i].pos < hits[j].pos
+		})
+	}
+	return seedIndex
+}
+
+// locateMatures locates each mature miRNA by sequence at its first position in each hairpin, looking up its seed
+// k-mer in the hairpin seed index.  Mature miRNAs shorter than the seed are searched for in each hairpin.
+// It returns a map of hairpin header : mature sites, sorted by start position and miRNA header.
+func locateMatures(mirnaMap map[string]*mirnaSeqDup, hairpinMap map[string]string,
+	seedIndex map[string][]hairpinHit) map[string][]matureSite {
+	sites := make(map[string][]matureSite)
+	for mirnaHeader, mirnaSeq := range mirnaMap {
+		mature := mirnaSeq.seq
+		switch {
+		case len(mature) == 0:
+		case len(mature) < isomirSeedLen:
+			for hairpinHeader, hairpinSeq := range hairpinMap {
+				if start := strings.Index(hairpinSeq, mature); start >= 0 {
+					sites[hairpinHeader] = append(sites[hairpinHeader],
+						matureSite{mirnaHeader, start, start + len(mature)})
+				}
+			}
+		default:
+			located := make(map[string]bool)
+			for _, hit := range seedIndex[mature[:isomirSeedLen]] {
+				if !located[hit.hairpin] && strings.HasPrefix(hairpinMap[hit.hairpin][hit.pos:], mature) {
+					located[hit.hairpin] = true
+					sites[hit.hairpin] = append(sites[hit.hairpin],
+						matureSite{mirnaHeader, hit.pos, hit.pos + len(mature)})
+				}
+			}
+		}
+	}
+	for _, hairpinSites := range sites {
+		sort.Slice(hairpinSites, func(i, j int) bool {
+			if hairpinSites[i].start != hairpinSites[j].start {
+				return hairpinSites[i].start < hairpinSites[j].start
+			}
+			return hairpinSites[i].mirna < hairpinSites[j].mirna
+		})
+	}
+	return sites
+}
+
+// templatedAlignment aligns a read to the start of a hairpin subsequence, allowing up to maxAddition nt of 3'
+// non-templated addition and one substitution (perfectly templated alignments are preferred).  It returns the
+// templated length of the read and any substitutions.
+func templatedAlignment(srna string, hairpinSeq string, maxAddition int) (int, []string, bool) {
+	for maxMismatches := 0; maxMismatches <= 1; maxMismatches++ {
+		for addition := 0; addition <= maxAddition && addition < len(srna); addition++ {
+			templLen := len(srna) - addition
+			if templLen > len(hairpinSeq) {
+				continue
+			}
+			var subs []string
+			for pos := 0; pos < templLen && len(subs) <= maxMismatches; pos++ {
+				if srna[pos] != hairpinSeq[pos] {
+					subs = append(subs, strconv.Itoa(pos+1)+":"+hairpinSeq[pos:pos+1]+">"+srna[pos:pos+1])
+				}
+			}
+			// a substitution at the 3' end of the templated read is treated as an addition
+			if len(subs) <= maxMismatches && (len(subs) == 0 || srna[templLen-1] == hairpinSeq[templLen-1]) {
+				return templLen, subs, true
+			}
+		}
+	}
+	return 0, nil, false
+}
+
+// IsomirCounts aggregates the isomiR counts for each mature miRNA.  It returns a map of mirna_header:meanSe or
+// individual counts, which can be passed to Compare.  If split is true, read counts are split by the number of mature
+// miRNAs a read is assigned to.
+func IsomirCounts(isomirMap map[string][]*Isomir, split bool) map[string]interface{} {
+	mirnaCounts := make(map[string]interface{})
+	for mirnaHeader, isomirs := range isomirMap {
+		acc := &countsAccumulator{}
+		for _, iso := range isomirs {
+			factor := 1.0
+			if split {
+				factor = 1.0 / float64(iso.Assignments)
+			}
+			acc.add(iso.Counts, factor)
+		}
+		mirnaCounts[mirnaHeader] = acc.result()
+	}
+	return mirnaCounts
+}
+
+// IsomirsToCsv writes the individual isomiRs for each mature miRNA to a csv file.  Read counts are NOT split.
+func IsomirsToCsv(isomirMap map[string][]*Isomir, outPrefix string, fileOrder []string) {
+	var mirnaHeaders []string
+	for mirnaHeader := range isomirMap {
+		mirnaHeaders = append(mirnaHeaders, mirnaHeader)
+	}
+	sort.Strings(mirnaHeaders)
+	firstRow := true
+	var rows [][]string
+	for _, mirnaHeader := range mirnaHeaders {
+		for _, iso := range isomirMap[mirnaHeader] {
+			if firstRow {
+				row := []string{"miRNA", "Hairpin", "sRNA", "Class", "5' shift", "3' shift", "Addition",
+					"Substitutions", "Times assigned"}
+				switch iso.Counts.(type) {
+				case *meanSe:
+					row = append(row, "Count", "Std. Err")
+				case *[]float64:
+					row = append(row, fileOrder...)
+				}
+				rows = append(rows, row)
+				firstRow = false
+			}
+			row := []string{mirnaHeader, iso.Hairpin, iso.Seq, iso.Class(), strconv.Itoa(iso.Shift5),
+				strconv.Itoa(iso.Shift3), iso.Addition, strings.Join(iso.Substitutions, ";"),
+				strconv.Itoa(iso.Assignments)}
+			switch v := iso.Counts.(type) {
+			case *meanSe:
+				row = append(row, strconv.FormatFloat(v.Mean, 'f', 3, 64), strconv.FormatFloat(v.Se, 'f', 8, 64))
+			case *[]float64:
+				for _, count := range *v {
+					row = append(row, strconv.FormatFloat(count, 'f', 3, 64))
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	writeCsv(rows, outPrefix+"_isomiR.csv")
+}
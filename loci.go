@@ -0,0 +1,240 @@
+package scramPkg
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// MergeAlignments combines alignment maps for reads of different lengths (from AlignReads) into a single alignment
+// map of ref_header:[srna_seq:[pos,pos,...],...].
+func MergeAlignments(alignmentMaps ...map[string]map[string][]int) map[string]map[string][]int {
+	mergedAlignmentMap := make(map[string]map[string][]int)
+	for _, alignmentMap := range alignmentMaps {
+		for header, alignment := range alignmentMap {
+			if _, ok := mergedAlignmentMap[header]; !ok {
+				mergedAlignmentMap[header] = make(map[string][]int)
+			}
+			for srna, positions := range alignment {
+				mergedAlignmentMap[header][srna] = append(mergedAlignmentMap[header][srna], positions...)
+			}
+		}
+	}
+	return mergedAlignmentMap
+}
+
+// Locus is a struct comprising a de novo sRNA locus and its summary statistics
+type Locus struct {
+	Header      string
+	Start       int         // Start is the locus start (from 5' fwd, starting at 1)
+	End         int         // End is the locus end (inclusive)
+	Counts      interface{} // Counts is the meanSe or individual counts of reads aligned to the locus
+	Abundance   float64     // Abundance is the mean count of reads aligned to the locus
+	UniqueReads int         // UniqueReads is the no. of distinct read sequences aligned to the locus
+	Reads       int         // Reads is the no. of read placements (distinct read sequences at each position)
+	DominantLen int         // DominantLen is the read length with the highest abundance
+	StrandBias  float64     // StrandBias is the proportion of abundance on the sense strand
+	// Complexity is UniqueReads / Abundance, so a locus dominated by one abundant read has low complexity.  It depends
+	// on how counts were normalised - with reads per million, it is the distinct reads per million aligned reads.
+	Complexity float64
+	PhaseScore float64 // PhaseScore is the phase score for the dominant read length (20-24 nt only)
+}
+
+// lociPlacement is a single read placement used to build loci
+type lociPlacement struct {
+	srna   string
+	pos    int
+	strand string
+}
+
+// FindLoci takes an alignment map (e.g. from MergeAlignments) and a sequence map as input.  Reads aligned to a
+// reference sequence are merged into a locus if no more than gap nt separate them.  Loci with an abundance below
+// minAbundance are discarded.  If split is true, read counts (including those used for the phase score) are split by
+// the number of times a read aligns.
+// It returns a slice of loci sorted by ref header and start position.
+func FindLoci(alignmentMap map[string]map[string][]int, seqMap map[string]interface{}, gap int,
+	minAbundance float64, split bool) []*Locus {
+	srnaAlignmentMap := calcTimesReadAligns(alignmentMap)
+	var headers []string
+	for header := range alignmentMap {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+
+	var loci []*Locus
+	for _, header := range headers {
+		var placements []lociPlacement
+		for srna, positions := range alignmentMap[header] {
+			for _, position := range positions {
+				switch {
+				case position > 0:
+					placements = append(placements, lociPlacement{srna, position, "+"})
+				case position < 0:
+					placements = append(placements, lociPlacement{srna, 0 - position, "-"})
+				}
+			}
+		}
+		sort.Slice(placements, func(i, j int) bool {
+			if placements[i].pos != placements[j].pos {
+				return placements[i].pos < placements[j].pos
+			}
+			return placements[i].srna < placements[j].srna
+		})
+		first := 0
+		end := 0
+		for i, placement := range placements {
+			if i > first && placement.pos-end-1 > gap {
+				loci = appendLocus(loci, header, placements[first:i], seqMap, srnaAlignmentMap, split,
+					minAbundance)
+				first = i
+			}
+			if i == first || placement.pos+len(placement.srna)-1 > end {
+				end = placement.pos + len(placement.srna) - 1
+			}
+		}
+		if len(placements) > 0 {
+			loci = appendLocus(loci, header, placements[first:], seqMap, srnaAlignmentMap, split, minAbundance)
+		}
+	}
+	return loci
+}
+
+// Generates a locus from a cluster of read placements and appends it to the loci if it passes the min. abundance
+func appendLocus(loci []*Locus, header string, placements []lociPlacement, seqMap map[string]interface{},
+	srnaAlignmentMap map[string]int, split bool, minAbundance float64) []*Locus {
+	singleLocus := &Locus{Header: header, Start: placements[0].pos}
+	acc := &countsAccumulator{}
+	uniqueReads := make(map[string]bool)
+	lenAbundance := make(map[int]float64)
+	var fwdAbundance float64
+	counts := make([]float64, len(placements))
+	for i, placement := range placements {
+		factor := 1.0
+		if split {
+			factor = 1.0 / float64(srnaAlignmentMap[placement.srna])
+		}
+		count := readMeanCount(seqMap[placement.srna]) * factor
+		counts[i] = count
+		acc.add(seqMap[placement.srna], factor)
+		singleLocus.Abundance += count
+		uniqueReads[placement.srna] = true
+		lenAbundance[len(placement.srna)] += count
+		if placement.strand == "+" {
+			fwdAbundance += count
+		}
+		if end := placement.pos + len(placement.srna) - 1; end > singleLocus.End {
+			singleLocus.End = end
+		}
+	}
+	if singleLocus.Abundance < minAbundance {
+		return loci
+	}
+	singleLocus.Counts = acc.result()
+	singleLocus.UniqueReads = len(uniqueReads)
+	singleLocus.Reads = len(placements)
+	for readLen, abundance := range lenAbundance {
+		if abundance > lenAbundance[singleLocus.DominantLen] ||
+			(abundance == lenAbundance[singleLocus.DominantLen] && readLen < singleLocus.DominantLen) {
+			singleLocus.DominantLen = readLen
+		}
+	}
+	if singleLocus.Abundance > 0 {
+		singleLocus.StrandBias = fwdAbundance / singleLocus.Abundance
+		singleLocus.Complexity = float64(singleLocus.UniqueReads) / singleLocus.Abundance
+	}
+	if singleLocus.DominantLen >= 20 && singleLocus.DominantLen <= 24 {
+		var phased []phasedRead
+		for i, placement := range placements {
+			if len(placement.srna) == singleLocus.DominantLen {
+				phased = append(phased, newPhasedRead(placement.pos, placement.strand, counts[i]))
+			}
+		}
+		singleLocus.PhaseScore, _ = phaseScore(phased, singleLocus.DominantLen)
+	}
+	return append(loci, singleLocus)
+}
+
+// phasedRead is a read placement used to calculate phasing, with the position corrected to the 5' end of the sense
+// read in a duplex
+type phasedRead struct {
+	pos    int
+	strand string
+	count  float64
+}
+
+// Generates a phasedRead.  Antisense reads are offset by 2 nt to account for the 2 nt 3' overhang of a Dicer duplex.
+func newPhasedRead(pos int, strand string, count float64) phasedRead {
+	if strand == "-" {
+		pos += 2
+	}
+	return phasedRead{pos, strand, count}
+}
+
+// phaseScore calculates the phase score (Guo et al. 2015) for each register of the period, and returns the highest
+// score and its register (the phase corrected position mod period).
+// score = ln((1 + 10 * P / (1 + U)) ^ (k - 2)), where P is the in-phase abundance, U the out-of-phase abundance and k
+// the no. of in-phase positions occupied (a score of 0 is given if k < 3).
+func phaseScore(reads []phasedRead, period int) (float64, int) {
+	inPhase := make([]float64, period)
+	cycles := make([]map[int]bool, period)
+	var total float64
+	for _, read := range reads {
+		register := ((read.pos-1)%period + period) % period
+		inPhase[register] += read.count
+		if cycles[register] == nil {
+			cycles[register] = make(map[int]bool)
+		}
+		cycles[register][read.pos] = true
+		total += read.count
+	}
+	bestScore := 0.0
+	bestRegister := 0
+	for register := 0; register < period; register++ {
+		k := len(cycles[register])
+		if k < 3 {
+			continue
+		}
+		outOfPhase := total - inPhase[register]
+		score := float64(k-2) * math.Log(1+10*inPhase[register]/(1+outOfPhase))
+		if score > bestScore {
+			bestScore = score
+			bestRegister = register
+		}
+	}
+	return bestScore, bestRegister
+}
+
+// LociToCsv writes the loci to a csv file.
+func LociToCsv(loci []*Locus, outPrefix string, fileOrder []string) {
+	var rows [][]string
+	for i, singleLocus := range loci {
+		if i == 0 {
+			row := []string{"Header", "Start", "End", "Length"}
+			switch singleLocus.Counts.(type) {
+			case meanSe:
+				row = append(row, "Count", "Std. Err")
+			case []float64:
+				row = append(row, fileOrder...)
+			}
+			row = append(row, "Unique reads", "Reads", "Dominant length", "Strand bias", "Complexity",
+				"Phase score")
+			rows = append(rows, row)
+		}
+		row := []string{singleLocus.Header, strconv.Itoa(singleLocus.Start), strconv.Itoa(singleLocus.End),
+			strconv.Itoa(singleLocus.End - singleLocus.Start + 1)}
+		switch v := singleLocus.Counts.(type) {
+		case meanSe:
+			row = append(row, strconv.FormatFloat(v.Mean, 'f', 3, 64), strconv.FormatFloat(v.Se, 'f', 8, 64))
+		case []float64:
+			for _, count := range v {
+				row = append(row, strconv.FormatFloat(count, 'f', 3, 64))
+			}
+		}
+		row = append(row, strconv.Itoa(singleLocus.UniqueReads), strconv.Itoa(singleLocus.Reads),
+			strconv.Itoa(singleLocus.DominantLen), strconv.FormatFloat(singleLocus.StrandBias, 'f', 3, 64),
+			strconv.FormatFloat(singleLocus.Complexity, 'g', 6, 64),
+			strconv.FormatFloat(singleLocus.PhaseScore, 'f', 3, 64))
+		rows = append(rows, row)
+	}
+	writeCsv(rows, outPrefix+"_loci.csv")
+}
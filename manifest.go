@@ -0,0 +1,182 @@
+package scramPkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Version is the scram package version recorded in run manifests.  It can be set at build time with
+// -ldflags "-X github.com/sfletc/scram2pkg.Version=...".
+var Version = "2.0.0-dev"
+
+// runLog records the read libraries loaded and the output files written, in order, while run manifests are open.
+// Entries no longer needed by an open manifest are trimmed when a manifest is closed, and the trimmed counts are kept
+// so that manifests can hold absolute positions in the log.
+var runLog struct {
+	sync.Mutex
+	libraries        []libraryTotal
+	outputs          []string
+	trimmedLibraries int
+	trimmedOutputs   int
+	open             map[*Manifest]bool
+}
+
+// libraryTotal is the total no. of reads loaded from a read file
+type libraryTotal struct {
+	File  string  `json:"file"`
+	Reads float64 `json:"reads"` // Reads is the no. of reads loaded, after length, adapter and min. count filtering
+}
+
+// Records a read library loaded by SeqLoad or IndvSeqLoad, if a manifest is open
+func recordLibrary(fileName string, totalCount float64) {
+	runLog.Lock()
+	defer runLog.Unlock()
+	if len(runLog.open) > 0 {
+		runLog.libraries = append(runLog.libraries, libraryTotal{fileName, totalCount})
+	}
+}
+
+// Records an output file written, if a manifest is open
+func recordOutput(outFile string) {
+	runLog.Lock()
+	defer runLog.Unlock()
+	if len(runLog.open) > 0 {
+		runLog.outputs = append(runLog.outputs, outFile)
+	}
+}
+
+// Trims the run log entries recorded before the first library and output of every open manifest.  runLog must be
+// locked.
+func trimRunLog() {
+	firstLibrary := runLog.trimmedLibraries + len(runLog.libraries)
+	firstOutput := runLog.trimmedOutputs + len(runLog.outputs)
+	for manifest := range runLog.open {
+		if manifest.firstLibrary < firstLibrary {
+			firstLibrary = manifest.firstLibrary
+		}
+		if manifest.firstOutput < firstOutput {
+			firstOutput = manifest.firstOutput
+		}
+	}
+	runLog.libraries = append([]libraryTotal(nil), runLog.libraries[firstLibrary-runLog.trimmedLibraries:]...)
+	runLog.outputs = append([]string(nil), runLog.outputs[firstOutput-runLog.trimmedOutputs:]...)
+	runLog.trimmedLibraries = firstLibrary
+	runLog.trimmedOutputs = firstOutput
+}
+
+// manifestFile is an input or output file in a run manifest
+type manifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest is the provenance record of a run - the inputs, parameters, read libraries loaded, outputs written,
+// package version and timestamps.  Libraries and outputs are those loaded and written (by any goroutine) between
+// NewManifest and Write, so manifests that are open at the same time share entries - manifests are not safe to use for
+// concurrent runs.  A manifest is only written if the caller writes it - functions such as ProfileToCsv and
+// CompareToCsv don't - and one that isn't written must be discarded, or the run log is never trimmed.
+type Manifest struct {
+	Version    string         `json:"version"`
+	Started    time.Time      `json:"started"`
+	Finished   time.Time      `json:"finished"`
+	Parameters interface{}    `json:"parameters"`
+	Inputs     []manifestFile `json:"inputs"`
+	Libraries  []libraryTotal `json:"libraries"`
+	Outputs    []manifestFile `json:"outputs"`
+
+	inputFiles   []string
+	firstLibrary int
+	firstOutput  int
+}
+
+// NewManifest starts the manifest for a run with the parameters (e.g. a Config) and input files
+func NewManifest(parameters interface{}, inputFiles ...string) *Manifest {
+	runLog.Lock()
+	defer runLog.Unlock()
+	manifest := &Manifest{Version: Version, Started: time.Now().UTC(), Parameters: parameters, inputFiles: inputFiles,
+		firstLibrary: runLog.trimmedLibraries + len(runLog.libraries),
+		firstOutput:  runLog.trimmedOutputs + len(runLog.outputs)}
+	if runLog.open == nil {
+		runLog.open = make(map[*Manifest]bool)
+	}
+	runLog.open[manifest] = true
+	return manifest
+}
+
+// Manifest starts the manifest for a run with the configuration, with the read files and reference file as inputs
+func (config *Config) Manifest() *Manifest {
+	inputFiles := append(append([]string(nil), config.ReadFileSet1...), config.ReadFileSet2...)
+	return NewManifest(config, append(inputFiles, config.AlignTo)...)
+}
+
+// Write finishes the manifest, with the sizes and SHA-256 checksums of the inputs and of the outputs written since
+// NewManifest, and writes it to a JSON file.  The manifest is closed, so it can only be written once, and not after
+// Discard.
+func (manifest *Manifest) Write(manifestFile string) error {
+	runLog.Lock()
+	if !runLog.open[manifest] {
+		runLog.Unlock()
+		return errors.New("manifest has already been written or discarded")
+	}
+	manifest.Finished = time.Now().UTC()
+	manifest.Libraries = append([]libraryTotal{}, runLog.libraries[manifest.firstLibrary-runLog.trimmedLibraries:]...)
+	outputFiles := append([]string(nil), runLog.outputs[manifest.firstOutput-runLog.trimmedOutputs:]...)
+	delete(runLog.open, manifest)
+	trimRunLog()
+	runLog.Unlock()
+
+	var err error
+	if manifest.Inputs, err = describeFiles(manifest.inputFiles); err != nil {
+		return err
+	}
+	if manifest.Outputs, err = describeFiles(outputFiles); err != nil {
+		return err
+	}
+	return writeFileAtomic(manifestFile, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(manifest)
+	})
+}
+
+// Discard closes the manifest without writing it (e.g. if the run fails), so the run log entries it holds are trimmed.
+// Discarding a manifest that has been written or discarded does nothing.
+func (manifest *Manifest) Discard() {
+	runLog.Lock()
+	defer runLog.Unlock()
+	if runLog.open[manifest] {
+		delete(runLog.open, manifest)
+		trimRunLog()
+	}
+}
+
+// describeFiles returns the path, size and SHA-256 checksum of each file, once each
+func describeFiles(files []string) ([]manifestFile, error) {
+	described := []manifestFile{}
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.New()
+		size, err := io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		described = append(described, manifestFile{file, size, hex.EncodeToString(hash.Sum(nil))})
+	}
+	return described, nil
+}
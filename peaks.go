@@ -0,0 +1,206 @@
+package scramPkg
+
+import (
+	"math"
+	"sort"
+)
+
+// PeakOptions are the options for CallPeaks
+type PeakOptions struct {
+	Background    int     // Background is the no. of nt either side of a position used to estimate the local background
+	MinHeight     float64 // MinHeight is the min. read depth at a peak position
+	MaxPValue     float64 // MaxPValue is the max. Poisson p-value at a peak position
+	MinReplicates int     // MinReplicates is the no. of replicates a position must pass in (0 for all replicates)
+}
+
+// DefaultPeakOptions returns the default peak calling options
+func DefaultPeakOptions() *PeakOptions {
+	return &PeakOptions{Background: 100, MinHeight: 1.0, MaxPValue: 1e-5}
+}
+
+// Peak is a struct comprising a region of a reference sequence strand with read depth significantly above the local
+// background
+type Peak struct {
+	Header     string
+	Start      int     // Start is the peak start (from 5' fwd, starting at 1)
+	End        int     // End is the peak end (inclusive)
+	Strand     string  // Strand is "+" or "-"
+	Summit     int     // Summit is the position with the highest mean depth
+	Height     float64 // Height is the mean read depth at the summit
+	Background float64 // Background is the expected depth at the summit
+	PValue     float64 // PValue is the Poisson p-value of the summit height given the background
+	Replicates int     // Replicates is the no. of replicates in which the summit passes the thresholds
+}
+
+// CallPeaks takes a profile alignments map (from ProfileSplit or ProfileNoSplit) and the reference slice as an input,
+// and calls peaks of read depth on each strand of each reference sequence.  A position passes if its depth is at least
+// MinHeight and the Poisson probability of that depth given the background is no more than MaxPValue.  The background
+// is the mean depth in the flanking Background nt either side of the position, or the mean depth of the strand if
+// that is higher.  For individual replicate counts, each replicate is tested separately and a position must pass in
+// at least MinReplicates replicates.  Runs of passing positions are reported as peaks, in refSlice order and sorted by
+// start.  Depths are treated as counts, so the p-values depend on how reads were normalised.
+func CallPeaks(profileAlignmentsMap map[string]interface{}, refSlice []*HeaderRef, opts *PeakOptions) []*Peak {
+	if opts == nil {
+		opts = DefaultPeakOptions()
+	}
+	var peaks []*Peak
+	coverageMap := ProfileCoverage(profileAlignmentsMap, refSlice)
+	for _, ref := range refSlice {
+		cov, ok := coverageMap[ref.Header]
+		if !ok {
+			continue
+		}
+		var refPeaks []*Peak
+		for _, strand := range []string{"+", "-"} {
+			strandDepths := cov.Fwd
+			if strand == "-" {
+				strandDepths = cov.Rvs
+			}
+			refPeaks = append(refPeaks, strandPeaks(ref.Header, strand, cov, strandDepths, opts)...)
+		}
+		sort.SliceStable(refPeaks, func(i, j int) bool { return refPeaks[i].Start < refPeaks[j].Start })
+		peaks = append(peaks, refPeaks...)
+	}
+	return peaks
+}
+
+// Calls the peaks on a single strand of a reference sequence
+func strandPeaks(header string, strand string, cov *CoverageProfile, strandDepths [][]float64,
+	opts *PeakOptions) []*Peak {
+	meanDepth := make([]float64, cov.RefLen)
+	for pos := range meanDepth {
+		meanDepth[pos] = cov.depth(strandDepths, pos)
+	}
+	testDepths := strandDepths
+	if cov.MeanSe {
+		testDepths = [][]float64{meanDepth}
+	}
+	required := opts.MinReplicates
+	if required < 1 || required > len(testDepths) {
+		required = len(testDepths)
+	}
+	var backgrounds []func(pos int) float64
+	for _, depths := range testDepths {
+		backgrounds = append(backgrounds, localBackground(depths, opts.Background))
+	}
+	meanBackground := localBackground(meanDepth, opts.Background)
+
+	var peaks []*Peak
+	var current *Peak
+	for pos := 0; pos < cov.RefLen; pos++ {
+		passed := 0
+		for col, depths := range testDepths {
+			if depths[pos] >= opts.MinHeight && depths[pos] > 0 &&
+				poissonUpperTail(depths[pos], backgrounds[col](pos)) <= opts.MaxPValue {
+				passed++
+			}
+		}
+		switch {
+		case passed < required:
+			current = nil
+		case current == nil:
+			current = &Peak{Header: header, Start: pos + 1, End: pos + 1, Strand: strand, Summit: pos + 1,
+				Height: meanDepth[pos], Replicates: passed}
+			peaks = append(peaks, current)
+		default:
+			current.End = pos + 1
+			if meanDepth[pos] > current.Height {
+				current.Summit = pos + 1
+				current.Height = meanDepth[pos]
+				current.Replicates = passed
+			}
+		}
+	}
+	for _, singlePeak := range peaks {
+		singlePeak.Background = meanBackground(singlePeak.Summit - 1)
+		singlePeak.PValue = poissonUpperTail(singlePeak.Height, singlePeak.Background)
+	}
+	return peaks
+}
+
+// localBackground returns a function giving the expected depth at a position (0-based) - the mean depth in the
+// flanking nt either side of the position, or the mean depth of all positions if that is higher
+func localBackground(depths []float64, flank int) func(pos int) float64 {
+	cumulative := make([]float64, len(depths)+1)
+	for pos, depth := range depths {
+		cumulative[pos+1] = cumulative[pos] + depth
+	}
+	globalMean := 0.0
+	if len(depths) > 0 {
+		globalMean = cumulative[len(depths)] / float64(len(depths))
+	}
+	return func(pos int) float64 {
+		start := pos - flank
+		if start < 0 {
+			start = 0
+		}
+		end := pos + flank + 1
+		if end > len(depths) {
+			end = len(depths)
+		}
+		flankLen := end - start - 1
+		if flankLen < 1 {
+			return globalMean
+		}
+		flankMean := (cumulative[end] - cumulative[start] - depths[pos]) / float64(flankLen)
+		return math.Max(flankMean, globalMean)
+	}
+}
+
+// poissonUpperTail calculates P(X >= x) for X ~ Poisson(lambda), with x rounded to the nearest integer
+func poissonUpperTail(x float64, lambda float64) float64 {
+	k := int(math.Floor(x + 0.5))
+	switch {
+	case k <= 0:
+		return 1.0
+	case lambda <= 0:
+		return 0.0
+	}
+	logLambda := math.Log(lambda)
+	logTerm := func(i int) float64 {
+		lgI, _ := math.Lgamma(float64(i + 1))
+		return -lambda + float64(i)*logLambda - lgI
+	}
+	if float64(k) > lambda {
+		// terms decrease above the mean, so sum upwards from k until they are negligible
+		var p float64
+		term := math.Exp(logTerm(k))
+		for i := k; term > 0 && term >= p*1e-16; i++ {
+			p += term
+			term *= lambda / float64(i+1)
+		}
+		return math.Min(p, 1.0)
+	}
+	// terms decrease below the mean, so sum the lower tail downwards from k - 1
+	var lower float64
+	term := math.Exp(logTerm(k - 1))
+	for i := k - 1; i >= 0 && term > 0 && term >= lower*1e-16; i-- {
+		lower += term
+		term *= float64(i) / lambda
+	}
+	return math.Max(1.0-lower, 0.0)
+}
+
+// PeaksToCsv writes the peaks to a csv file.  Heights, backgrounds, p-values and scores are written to 6 significant
+// digits, so small p-values are not rounded to 0.
+func PeaksToCsv(peaks []*Peak, outPrefix string) {
+	opts := DefaultOutputOptions()
+	opts.FloatFormat = 'g'
+	opts.Precision = 6
+	writeTable(outPrefix+"_peaks.csv", opts, func(emit emitRow) error {
+		columns := []string{"Header", "Start", "End", "Width", "Strand", "Summit", "Height", "Background", "P-value",
+			"Score", "Replicates"}
+		var row []interface{}
+		for _, singlePeak := range peaks {
+			score := -math.Log10(math.Max(singlePeak.PValue, math.SmallestNonzeroFloat64))
+			row = append(row[:0], singlePeak.Header, singlePeak.Start, singlePeak.End,
+				singlePeak.End-singlePeak.Start+1, singlePeak.Strand, singlePeak.Summit, singlePeak.Height,
+				singlePeak.Background, singlePeak.PValue, score,
+				singlePeak.Replicates)
+			if err := emit(columns, row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
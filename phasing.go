@@ -0,0 +1,137 @@
+package scramPkg
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// PhasedWindow is a struct comprising a window of a reference sequence with phased siRNAs
+type PhasedWindow struct {
+	Header          string
+	Start           int     // Start is the window start (from 5' fwd, starting at 1)
+	End             int     // End is the window end (inclusive)
+	Register        int     // Register is the in-phase offset (1 to period) - in-phase reads start at Register + n * period
+	PhaseScore      float64 // PhaseScore is the phase score for the register
+	PValue          float64 // PValue is the hypergeometric p-value for the no. of occupied in-phase positions
+	PhasedAbundance float64 // PhasedAbundance is the abundance of in-phase reads
+	TotalAbundance  float64 // TotalAbundance is the abundance of all reads of length period in the window
+}
+
+// PhasedWindows takes a profile alignments map (from ProfileSplit or ProfileNoSplit) and the reference slice as input.
+// A window of cycles * period nt is slid along each reference sequence by step nt and the reads of length period
+// (e.g. 21 nt) are tested for phasing on both strands, with antisense reads offset by the 2 nt 3' overhang.  Windows
+// with a phase score >= minScore are returned, in ref slice order.  A step < 1 is treated as a step of period nt.
+func PhasedWindows(profileAlignmentsMap map[string]interface{}, refSlice []*HeaderRef, period int, cycles int,
+	step int, minScore float64) []*PhasedWindow {
+	if step < 1 {
+		step = period
+	}
+	var windows []*PhasedWindow
+	windowLen := period * cycles
+	for _, ref := range refSlice {
+		alignments, ok := profileAlignmentsMap[ref.Header]
+		if !ok {
+			continue
+		}
+		var reads []phasedRead
+		for _, alignment := range *alignments.(*singleAlignments) {
+			if len(alignment.Seq) == period {
+				reads = append(reads, newPhasedRead(alignment.Pos, alignment.Strand,
+					readMeanCount(alignment.Alignments)))
+			}
+		}
+		if len(reads) == 0 {
+			continue
+		}
+		sort.Slice(reads, func(i, j int) bool { return reads[i].pos < reads[j].pos })
+		first := 0
+		last := 0
+		for start := 1; start == 1 || start+windowLen-1 <= len(ref.Seq); start += step {
+			// the first window is emitted even if the reference is shorter than the window
+			end := start + windowLen - 1
+			if end > len(ref.Seq) {
+				end = len(ref.Seq)
+			}
+			for first < len(reads) && reads[first].pos < start {
+				first++
+			}
+			if last < first {
+				last = first
+			}
+			for last < len(reads) && reads[last].pos <= end {
+				last++
+			}
+			windowReads := reads[first:last]
+			score, register := phaseScore(windowReads, period)
+			if len(windowReads) == 0 || score < minScore {
+				continue
+			}
+			window := &PhasedWindow{Header: ref.Header, Start: start, End: end, Register: register + 1,
+				PhaseScore: score}
+			occupied := make(map[string]bool)
+			inPhaseOccupied := 0
+			for _, read := range windowReads {
+				window.TotalAbundance += read.count
+				inPhase := (read.pos-1)%period == register
+				if inPhase {
+					window.PhasedAbundance += read.count
+				}
+				position := read.strand + strconv.Itoa(read.pos)
+				if !occupied[position] {
+					occupied[position] = true
+					if inPhase {
+						inPhaseOccupied++
+					}
+				}
+			}
+			inPhasePositions := 0
+			for pos := start; pos <= end; pos++ {
+				if (pos-1)%period == register {
+					inPhasePositions++
+				}
+			}
+			window.PValue = phaseHypergeometric(2*(end-start+1), 2*inPhasePositions, len(occupied), inPhaseOccupied)
+			windows = append(windows, window)
+		}
+	}
+	return windows
+}
+
+// phaseHypergeometric calculates the probability of k or more of n occupied positions being in-phase, from m
+// positions (both strands) of which inPhase are in-phase (Chen et al. 2007).
+func phaseHypergeometric(m int, inPhase int, n int, k int) float64 {
+	var p float64
+	for x := k; x <= n && x <= inPhase; x++ {
+		p += math.Exp(logChoose(inPhase, x) + logChoose(m-inPhase, n-x) - logChoose(m, n))
+	}
+	if p > 1 {
+		p = 1
+	}
+	return p
+}
+
+// Natural log of the binomial coefficient n choose k
+func logChoose(n int, k int) float64 {
+	if k < 0 || k > n {
+		return math.Inf(-1)
+	}
+	lgN, _ := math.Lgamma(float64(n + 1))
+	lgK, _ := math.Lgamma(float64(k + 1))
+	lgNK, _ := math.Lgamma(float64(n - k + 1))
+	return lgN - lgK - lgNK
+}
+
+// PhasedToCsv writes the phased windows to a csv file.
+func PhasedToCsv(windows []*PhasedWindow, period int, outPrefix string) {
+	rows := [][]string{{"Header", "Start", "End", "Register", "Phase score", "P-value", "Phased abundance",
+		"Total abundance"}}
+	for _, window := range windows {
+		rows = append(rows, []string{window.Header, strconv.Itoa(window.Start), strconv.Itoa(window.End),
+			strconv.Itoa(window.Register), strconv.FormatFloat(window.PhaseScore, 'f', 3, 64),
+			strconv.FormatFloat(window.PValue, 'g', 6, 64),
+			strconv.FormatFloat(window.PhasedAbundance, 'f', 3, 64),
+			strconv.FormatFloat(window.TotalAbundance, 'f', 3, 64)})
+	}
+	writeCsv(rows, outPrefix+"_"+strconv.Itoa(period)+"_phased.csv")
+}
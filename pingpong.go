@@ -0,0 +1,193 @@
+package scramPkg
+
+import (
+	"github.com/montanaflynn/stats"
+	"sort"
+	"strconv"
+)
+
+// pingPongOverlap is the 5' overlap (nt) between sense and antisense piRNAs generated by the ping-pong cycle
+const pingPongOverlap = 10
+
+// PingPongSignature is a struct comprising the ping-pong signature of the reads aligned to a reference sequence
+type PingPongSignature struct {
+	Overlaps []float64 // Overlaps[n-1] is the overlap score for sense/antisense read pairs with an n nt 5' overlap
+	ZScore   float64   // ZScore is the Z-score of the 10 nt overlap score against the other overlap scores
+	Frac1U   float64   // Frac1U is the proportion of read abundance with a U (T) at position 1
+	Frac10A  float64   // Frac10A is the proportion of read abundance (reads of 10 nt or more) with an A at position 10
+}
+
+// PingPong takes a profile map (from ProfileNoSplit or ProfileSplit) and calculates the ping-pong signature of the
+// reads aligned to each reference sequence.  The overlap score for an n nt 5' overlap (1 to maxOverlap) is the sum of
+// the products of the mean counts of each sense and antisense read pair whose 5' ends overlap by n nt.
+// It returns a map of ref_header:PingPongSignature
+func PingPong(profileMap map[string]interface{}, maxOverlap int) map[string]*PingPongSignature {
+	if maxOverlap < pingPongOverlap+1 {
+		maxOverlap = pingPongOverlap + 1
+	}
+	pingPongMap := make(map[string]*PingPongSignature)
+	for header, alignments := range profileMap {
+		singlePingPong := &PingPongSignature{Overlaps: overlapDistribution(alignments.(*singleAlignments), maxOverlap, 0)}
+		singlePingPong.ZScore = overlapZScore(singlePingPong.Overlaps, pingPongOverlap)
+		var total, total10, u1, a10 float64
+		for _, alignment := range *alignments.(*singleAlignments) {
+			count := readMeanCount(alignment.Alignments)
+			total += count
+			if alignment.Seq[0] == 'T' {
+				u1 += count
+			}
+			if len(alignment.Seq) >= pingPongOverlap {
+				total10 += count
+				if alignment.Seq[pingPongOverlap-1] == 'A' {
+					a10 += count
+				}
+			}
+		}
+		if total > 0 {
+			singlePingPong.Frac1U = u1 / total
+		}
+		if total10 > 0 {
+			singlePingPong.Frac10A = a10 / total10
+		}
+		pingPongMap[header] = singlePingPong
+	}
+	return pingPongMap
+}
+
+// overlapDistribution calculates the overlap scores for sense/antisense read pairs with 5' overlaps of 1 to
+// maxOverlap nt.  A sense read with its 5' end at p and an antisense read with its 5' end at q overlap by q-p+1 nt.
+// Only reads of readLen are included, or all reads if readLen is 0.
+func overlapDistribution(alignments *singleAlignments, maxOverlap int, readLen int) []float64 {
+	sense := make(map[int]float64)
+	antisense := make(map[int]float64)
+	for _, alignment := range *alignments {
+		if readLen > 0 && len(alignment.Seq) != readLen {
+			continue
+		}
+		count := readMeanCount(alignment.Alignments)
+		switch alignment.Strand {
+		case "+":
+			sense[alignment.Pos] += count
+		case "-":
+			antisense[alignment.Pos+len(alignment.Seq)-1] += count
+		}
+	}
+	overlaps := make([]float64, maxOverlap)
+	for p, senseCount := range sense {
+		for overlap := 1; overlap <= maxOverlap; overlap++ {
+			overlaps[overlap-1] += senseCount * antisense[p+overlap-1]
+		}
+	}
+	return overlaps
+}
+
+// overlapZScore calculates the Z-score of the score for an overlap against the scores for all other overlaps.  It is
+// 0 if the other scores do not vary.
+func overlapZScore(overlaps []float64, overlap int) float64 {
+	if overlap < 1 || overlap > len(overlaps) {
+		return 0.0
+	}
+	var background []float64
+	for i, score := range overlaps {
+		if i != overlap-1 {
+			background = append(background, score)
+		}
+	}
+	backgroundMean, _ := stats.Mean(background)
+	backgroundStdDev, _ := stats.StandardDeviationSample(background)
+	if backgroundStdDev == 0 {
+		return 0.0
+	}
+	return (overlaps[overlap-1] - backgroundMean) / backgroundStdDev
+}
+
+// PingPongToCsv writes the ping-pong signature of each reference sequence to a csv file.
+func PingPongToCsv(pingPongMap map[string]*PingPongSignature, outPrefix string) {
+	var headers []string
+	for header := range pingPongMap {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+	writeTable(outPrefix+"_pingpong.csv", nil, func(emit emitRow) error {
+		var columns []string
+		var row []interface{}
+		for _, header := range headers {
+			singlePingPong := pingPongMap[header]
+			if columns == nil {
+				columns = []string{"Header", "Z-score (10 nt)", "1U fraction", "10A fraction"}
+				for overlap := range singlePingPong.Overlaps {
+					columns = append(columns, "Overlap "+strconv.Itoa(overlap+1))
+				}
+			}
+			row = append(row[:0], header, singlePingPong.ZScore, singlePingPong.Frac1U, singlePingPong.Frac10A)
+			for _, score := range singlePingPong.Overlaps {
+				row = append(row, score)
+			}
+			if err := emit(columns, row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DicerSignature is a struct comprising the Dicer duplex signature of the reads of a single length aligned to a
+// reference sequence
+type DicerSignature struct {
+	Overlaps  []float64 // Overlaps[n-1] is the overlap score for sense/antisense read pairs with an n nt 5' overlap
+	ZScore    float64   // ZScore is the Z-score of the duplex (read length - 2 nt) overlap score against the others
+	Frequency float64   // Frequency is the duplex overlap score as a proportion of all overlap scores
+}
+
+// DuplexSignature takes a profile map (from ProfileNoSplit or ProfileSplit) and calculates the Dicer duplex signature
+// of the reads of readLen aligned to each reference sequence.  Sense and antisense reads from a Dicer duplex with 2 nt
+// 3' overhangs overlap by readLen - 2 nt (e.g. 19 nt for 21-mers).  Overlap scores are calculated as for PingPong, for
+// overlaps of 1 to readLen nt.
+// It returns a map of ref_header:DicerSignature
+func DuplexSignature(profileMap map[string]interface{}, readLen int) map[string]*DicerSignature {
+	duplexMap := make(map[string]*DicerSignature)
+	if readLen < 3 {
+		return duplexMap
+	}
+	for header, alignments := range profileMap {
+		signature := &DicerSignature{Overlaps: overlapDistribution(alignments.(*singleAlignments), readLen, readLen)}
+		signature.ZScore = overlapZScore(signature.Overlaps, readLen-2)
+		var total float64
+		for _, score := range signature.Overlaps {
+			total += score
+		}
+		if total > 0 {
+			signature.Frequency = signature.Overlaps[readLen-3] / total
+		}
+		duplexMap[header] = signature
+	}
+	return duplexMap
+}
+
+// DuplexToCsv writes the Dicer duplex signature of each reference sequence to a csv file.
+func DuplexToCsv(duplexMap map[string]*DicerSignature, readLen int, outPrefix string) {
+	var headers []string
+	for header := range duplexMap {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+	duplexOverlap := strconv.Itoa(readLen - 2)
+	writeTable(outPrefix+"_"+strconv.Itoa(readLen)+"_duplex.csv", nil, func(emit emitRow) error {
+		columns := []string{"Header", "Z-score (" + duplexOverlap + " nt)", "Frequency (" + duplexOverlap + " nt)"}
+		for overlap := 1; overlap <= readLen; overlap++ {
+			columns = append(columns, "Overlap "+strconv.Itoa(overlap))
+		}
+		var row []interface{}
+		for _, header := range headers {
+			signature := duplexMap[header]
+			row = append(row[:0], header, signature.ZScore, signature.Frequency)
+			for _, score := range signature.Overlaps {
+				row = append(row, score)
+			}
+			if err := emit(columns, row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,324 @@
+package scramPkg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MatureArm is a struct comprising a mature miRNA and its location within a precursor (0-based, end exclusive)
+type MatureArm struct {
+	Name  string
+	Arm   string // Arm is "5p" or "3p"
+	Start int
+	End   int
+}
+
+// overlap returns the no. of nt of a region (0-based, end exclusive) that overlap the arm
+func (arm *MatureArm) overlap(start int, end int) int {
+	if start < arm.Start {
+		start = arm.Start
+	}
+	if end > arm.End {
+		end = arm.End
+	}
+	return end - start
+}
+
+// Precursor is a struct comprising a miRNA precursor (hairpin) sequence and the mature miRNAs derived from it
+type Precursor struct {
+	Name string
+	Seq  string
+	Arms []*MatureArm // Arms are sorted by start position
+}
+
+// gffMirna is a miRNA_primary_transcript or miRNA record from a miRBase GFF3 file
+type gffMirna struct {
+	id          string
+	name        string
+	derivesFrom string
+	start       int
+	end         int
+	strand      string
+}
+
+// PrecursorLoad loads miRNA precursors from a hairpin FASTA file (i.e. miRBase hairpin.fa) and locates their mature
+// miRNAs.  If gffFile is not empty, mature locations are calculated from the miRNA_primary_transcript and miRNA
+// (Derives_from) records of a miRBase GFF3 file.  Otherwise mature miRNAs from mirnaMap (from MirLoad) are located by
+// sequence.  Precursor and mature names are the first word of a header or the GFF3 Name attribute.
+// It returns a map of precursor name : precursor
+func PrecursorLoad(hairpinFile string, gffFile string, mirnaMap map[string]*mirnaSeqDup) map[string]*Precursor {
+	hairpinMap, _ := HairpinLoad(hairpinFile)
+	precursorMap := make(map[string]*Precursor)
+	for name, hairpinSeq := range hairpinMap {
+		precursorMap[name] = &Precursor{Name: name, Seq: hairpinSeq}
+	}
+	switch {
+	case gffFile != "":
+		locateGffMatures(precursorMap, gffFile)
+	default:
+		for name, sites := range locateMatures(mirnaMap, hairpinMap, hairpinSeedIndex(hairpinMap)) {
+			hairpin := precursorMap[name]
+			for _, site := range sites {
+				hairpin.Arms = append(hairpin.Arms, &MatureArm{Name: site.mirna, Start: site.start, End: site.end})
+			}
+		}
+	}
+	for _, hairpin := range precursorMap {
+		assignArms(hairpin)
+	}
+	return precursorMap
+}
+
+// Locates the mature miRNAs in each precursor from a miRBase GFF3 file
+func locateGffMatures(precursorMap map[string]*Precursor, gffFile string) {
+	primaries := make(map[string]*gffMirna)
+	var matures []*gffMirna
+	f, err := os.Open(gffFile)
+	if err != nil {
+		fmt.Println("Problem opening miRBase GFF3 file " + gffFile)
+		errorShutdown()
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimRight(scanner.Text(), "\r"), "\t")
+		if len(fields) != 9 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		start, startErr := strconv.Atoi(fields[3])
+		end, endErr := strconv.Atoi(fields[4])
+		if startErr != nil || endErr != nil {
+			fmt.Println("miRBase GFF3 file format problem - bad coordinates in " + gffFile)
+			errorShutdown()
+		}
+		attributes := gffAttributes(fields[8])
+		record := &gffMirna{attributes["ID"], attributes["Name"], attributes["Derives_from"], start, end, fields[6]}
+		switch fields[2] {
+		case "miRNA_primary_transcript":
+			primaries[record.id] = record
+		case "miRNA":
+			matures = append(matures, record)
+		}
+	}
+	for _, mature := range matures {
+		primary, ok := primaries[mature.derivesFrom]
+		if !ok {
+			continue
+		}
+		hairpin, ok := precursorMap[primary.name]
+		if !ok {
+			continue
+		}
+		start := mature.start - primary.start
+		if primary.strand == "-" {
+			start = primary.end - mature.end
+		}
+		end := start + mature.end - mature.start + 1
+		if start < 0 || end > len(hairpin.Seq) {
+			fmt.Println("Warning: " + mature.name + " lies outside precursor " + primary.name)
+			continue
+		}
+		hairpin.Arms = append(hairpin.Arms, &MatureArm{Name: mature.name, Start: start, End: end})
+	}
+}
+
+// Sorts the mature miRNAs of a precursor by position and assigns them to the 5p or 3p arm.  Where a precursor has a
+// single mature miRNA, the arm is taken from a -5p / -3p name suffix, or else its position in the hairpin.
+func assignArms(hairpin *Precursor) {
+	sort.Slice(hairpin.Arms, func(i, j int) bool { return hairpin.Arms[i].Start < hairpin.Arms[j].Start })
+	for i, arm := range hairpin.Arms {
+		switch {
+		case len(hairpin.Arms) > 1 && i == 0:
+			arm.Arm = "5p"
+		case len(hairpin.Arms) > 1:
+			arm.Arm = "3p"
+		case strings.HasSuffix(arm.Name, "-5p"):
+			arm.Arm = "5p"
+		case strings.HasSuffix(arm.Name, "-3p"):
+			arm.Arm = "3p"
+		case arm.Start+arm.End < len(hairpin.Seq):
+			arm.Arm = "5p"
+		default:
+			arm.Arm = "3p"
+		}
+	}
+}
+
+// PrecursorCounts is a struct comprising the reads aligned to each region of a precursor.  Counts are meanSe or
+// individual counts.
+type PrecursorCounts struct {
+	Mature      *MatureArm // Mature is the arm with the highest abundance (nil if no arm reads)
+	Star        *MatureArm // Star is the other (passenger) arm, if annotated
+	MatureReads interface{}
+	StarReads   interface{}
+	LoopReads   interface{} // LoopReads are reads centred between the 5p and 3p arms
+	OtherReads  interface{} // OtherReads are all other reads aligned to the precursor
+	Unique      float64     // Unique is the mean abundance of reads that align to this precursor only
+	Shared      float64     // Shared is the mean abundance of reads that also align to other precursors
+}
+
+// PrecursorQuant aligns reads exactly to the precursors in the sense orientation.  A read is assigned to a mature arm
+// if at least half of it overlaps the arm, to the loop if it is centred between the arms, and otherwise to other.
+// Reads that align to more than one precursor (e.g. identical mature miRNAs from different loci) are reported as
+// shared, and if split is true their counts are split by the number of precursors they align to.
+// It returns a map of precursor name : PrecursorCounts
+func PrecursorQuant(seqMap map[string]interface{}, precursorMap map[string]*Precursor,
+	split bool) map[string]*PrecursorCounts {
+	hairpinMap := make(map[string]string)
+	for name, hairpin := range precursorMap {
+		hairpinMap[name] = hairpin.Seq
+	}
+	seedIndex := hairpinSeedIndex(hairpinMap)
+
+	type regionAccs struct {
+		arms     []*countsAccumulator
+		loop     *countsAccumulator
+		other    *countsAccumulator
+		armMeans []float64
+		unique   float64
+		shared   float64
+	}
+	accs := make(map[string]*regionAccs)
+	// the counts type (meanSe or individual counts) of the results, from any read
+	var template interface{}
+	for _, counts := range seqMap {
+		template = counts
+		break
+	}
+	for srna, counts := range seqMap {
+		if len(srna) < isomirSeedLen {
+			continue
+		}
+		hits := make(map[string]int)
+		for _, hit := range seedIndex[srna[:isomirSeedLen]] {
+			hairpinSeq := hairpinMap[hit.hairpin]
+			if _, ok := hits[hit.hairpin]; !ok && hit.pos+len(srna) <= len(hairpinSeq) &&
+				hairpinSeq[hit.pos:hit.pos+len(srna)] == srna {
+				hits[hit.hairpin] = hit.pos
+			}
+		}
+		factor := 1.0
+		if split && len(hits) > 0 {
+			factor = 1.0 / float64(len(hits))
+		}
+		count := readMeanCount(counts) * factor
+		for name, start := range hits {
+			hairpin := precursorMap[name]
+			if _, ok := accs[name]; !ok {
+				accs[name] = &regionAccs{loop: &countsAccumulator{}, other: &countsAccumulator{},
+					armMeans: make([]float64, len(hairpin.Arms))}
+				for range hairpin.Arms {
+					accs[name].arms = append(accs[name].arms, &countsAccumulator{})
+				}
+			}
+			region := accs[name]
+			if len(hits) > 1 {
+				region.shared += count
+			} else {
+				region.unique += count
+			}
+			end := start + len(srna)
+			assigned := false
+			for i, arm := range hairpin.Arms {
+				if 2*arm.overlap(start, end) >= len(srna) {
+					region.arms[i].add(counts, factor)
+					region.armMeans[i] += count
+					assigned = true
+					break
+				}
+			}
+			centre := start + end
+			switch {
+			case assigned:
+			case len(hairpin.Arms) > 1 && centre > 2*hairpin.Arms[0].End &&
+				centre < 2*hairpin.Arms[len(hairpin.Arms)-1].Start:
+				region.loop.add(counts, factor)
+			default:
+				region.other.add(counts, factor)
+			}
+		}
+	}
+
+	precursorCountsMap := make(map[string]*PrecursorCounts)
+	for name, region := range accs {
+		hairpin := precursorMap[name]
+		singleCounts := &PrecursorCounts{LoopReads: region.loop.resultLike(template),
+			OtherReads: region.other.resultLike(template), Unique: region.unique, Shared: region.shared,
+			MatureReads: (&countsAccumulator{}).resultLike(template),
+			StarReads:   (&countsAccumulator{}).resultLike(template)}
+		matureIdx := -1
+		for i := range hairpin.Arms {
+			if region.armMeans[i] > 0 && (matureIdx < 0 || region.armMeans[i] > region.armMeans[matureIdx]) {
+				matureIdx = i
+			}
+		}
+		if matureIdx >= 0 {
+			singleCounts.Mature = hairpin.Arms[matureIdx]
+			singleCounts.MatureReads = region.arms[matureIdx].resultLike(template)
+			for i, arm := range hairpin.Arms {
+				if i != matureIdx && arm.Arm != singleCounts.Mature.Arm {
+					singleCounts.Star = arm
+					singleCounts.StarReads = region.arms[i].resultLike(template)
+					break
+				}
+			}
+		}
+		precursorCountsMap[name] = singleCounts
+	}
+	return precursorCountsMap
+}
+
+// PrecursorsToCsv writes the mature, star, loop and other read counts for each precursor to a csv file.
+func PrecursorsToCsv(precursorCountsMap map[string]*PrecursorCounts, outPrefix string, fileOrder []string) {
+	var names []string
+	for name := range precursorCountsMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var rows [][]string
+	for i, name := range names {
+		singleCounts := precursorCountsMap[name]
+		if i == 0 {
+			row := []string{"Precursor", "Mature", "Mature arm", "Star"}
+			for _, region := range []string{"Mature", "Star", "Loop", "Other"} {
+				switch singleCounts.LoopReads.(type) {
+				case meanSe:
+					row = append(row, region+" count", region+" std. err")
+				case []float64:
+					for _, file := range fileOrder {
+						row = append(row, region+" "+file)
+					}
+				}
+			}
+			row = append(row, "Unique abundance", "Shared abundance")
+			rows = append(rows, row)
+		}
+		row := []string{name, "", "", ""}
+		if singleCounts.Mature != nil {
+			row[1] = singleCounts.Mature.Name
+			row[2] = singleCounts.Mature.Arm
+		}
+		if singleCounts.Star != nil {
+			row[3] = singleCounts.Star.Name
+		}
+		for _, regionCounts := range []interface{}{singleCounts.MatureReads, singleCounts.StarReads,
+			singleCounts.LoopReads, singleCounts.OtherReads} {
+			switch v := regionCounts.(type) {
+			case meanSe:
+				row = append(row, strconv.FormatFloat(v.Mean, 'f', 3, 64), strconv.FormatFloat(v.Se, 'f', 8, 64))
+			case []float64:
+				for _, count := range v {
+					row = append(row, strconv.FormatFloat(count, 'f', 3, 64))
+				}
+			}
+		}
+		row = append(row, strconv.FormatFloat(singleCounts.Unique, 'f', 3, 64),
+			strconv.FormatFloat(singleCounts.Shared, 'f', 3, 64))
+		rows = append(rows, row)
+	}
+	writeCsv(rows, outPrefix+"_precursor.csv")
+}
@@ -1,11 +1,8 @@
 package scramPkg
 
 import (
-	"encoding/csv"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
+	"io"
 	"sort"
 	"strconv"
 	"sync"
@@ -166,60 +163,66 @@ func profileSplitWorker(alignmentsForGoroutine chan alignmentStruct, outputFromG
 }
 
 //ProfileToCsv writes the  den results to a csv file
+//No run manifest is written - see Manifest.
 func ProfileToCsv(profileAlignmentsMap map[string]interface{}, refSlice []*HeaderRef, nt int, outPrefix string, fileOrder []string) {
+	if err := ProfileToFile(profileAlignmentsMap, refSlice, nt, outPrefix, fileOrder, nil); err != nil {
+		fmt.Println("\nCan't write profile output: " + err.Error())
+		errorShutdown()
+	}
+}
 
-	firstRow := true
-	var rows [][]string
-	for _, ref := range refSlice {
-		if alignments, ok := profileAlignmentsMap[ref.Header]; ok {
-			for _, alignment := range *alignments.(*singleAlignments) {
-				switch v := alignment.Alignments.(type) {
-				case *meanSe:
-					if firstRow {
-						rows = [][]string{
-							{"Header", "len", "sRNA", "Position", "Strand", "Count", "Std. Err", "Times aligned"},
-						}
-						firstRow = false
-					}
-					row := []string{ref.Header, strconv.Itoa(len(ref.Seq)),
-						alignment.Seq, strconv.Itoa(alignment.Pos),
-						alignment.Strand,
-						strconv.FormatFloat(v.Mean, 'f', 3, 64),
-						strconv.FormatFloat(v.Se, 'f', 8, 64),
-						strconv.Itoa(alignment.timesAligned)}
-					rows = append(rows, row)
-				case *[]float64:
-					if firstRow {
-						row := []string{"Header", "len", "sRNA", "Position", "Strand", "Times aligned"}
-						row = append(row, fileOrder...)
-						rows = append(rows, row)
-						firstRow = false
-					}
+//ProfileToFile writes the den results to a file in the format set by opts (csv, tsv, jsonl or col -
+//DefaultOutputOptions if nil).  The file extension is set by the format.  The file is written to a temporary file
+//which is renamed on success, so a partial file is never left.
+func ProfileToFile(profileAlignmentsMap map[string]interface{}, refSlice []*HeaderRef, nt int, outPrefix string,
+	fileOrder []string, opts *OutputOptions) error {
+	if opts == nil {
+		opts = DefaultOutputOptions()
+	}
+	return writeFileAtomic(outPrefix+"_"+strconv.Itoa(nt)+opts.fileExt(), func(w io.Writer) error {
+		return WriteProfile(w, profileAlignmentsMap, refSlice, fileOrder, opts)
+	})
+}
 
-					row := []string{ref.Header, strconv.Itoa(len(ref.Seq)),
-						alignment.Seq, strconv.Itoa(alignment.Pos),
-						alignment.Strand, strconv.Itoa(alignment.timesAligned)}
-					pos := 0
-					for pos < len(*v) {
-						row = append(row, strconv.FormatFloat((*v)[pos], 'f', 3, 64))
-						pos++
-					}
-					rows = append(rows, row)
+//WriteProfile writes the den results to w in the format set by opts (DefaultOutputOptions if nil).
+func WriteProfile(w io.Writer, profileAlignmentsMap map[string]interface{}, refSlice []*HeaderRef, fileOrder []string,
+	opts *OutputOptions) error {
+	return streamTable(w, opts, func(emit emitRow) error {
+		return profileRows(profileAlignmentsMap, refSlice, fileOrder, emit)
+	})
+}
+
+//profileRows generates the rows for a profile map in refSlice order, passing each to emit.  Counts are float64 and
+//standard errors are stdErr.
+func profileRows(profileAlignmentsMap map[string]interface{}, refSlice []*HeaderRef, fileOrder []string,
+	emit emitRow) error {
+	meanSeColumns := []string{"Header", "len", "sRNA", "Position", "Strand", "Count", "Std. Err", "Times aligned"}
+	countsColumns := append([]string{"Header", "len", "sRNA", "Position", "Strand", "Times aligned"}, fileOrder...)
+	var row []interface{}
+	for _, ref := range refSlice {
+		alignments, ok := profileAlignmentsMap[ref.Header]
+		if !ok {
+			continue
+		}
+		for _, alignment := range *alignments.(*singleAlignments) {
+			var err error
+			switch v := alignment.Alignments.(type) {
+			case *meanSe:
+				row = append(row[:0], ref.Header, len(ref.Seq), alignment.Seq, alignment.Pos, alignment.Strand,
+					v.Mean, stdErr(v.Se), alignment.timesAligned)
+				err = emit(meanSeColumns, row)
+			case *[]float64:
+				row = append(row[:0], ref.Header, len(ref.Seq), alignment.Seq, alignment.Pos, alignment.Strand,
+					alignment.timesAligned)
+				for _, count := range *v {
+					row = append(row, count)
 				}
+				err = emit(countsColumns, row)
+			}
+			if err != nil {
+				return err
 			}
 		}
 	}
-	outFile := outPrefix + "_" + strconv.Itoa(nt) + ".csv"
-	outDir := filepath.Dir(outFile)
-	os.MkdirAll(outDir, 0777)
-	f, err := os.Create(outFile)
-	if err != nil {
-		fmt.Println("Can't open csv file for writing")
-		errorShutdown()
-	}
-	w := csv.NewWriter(f)
-	w.WriteAll(rows)
-	if err := w.Error(); err != nil {
-		log.Fatalln("error writing csv:", err)
-	}
+	return nil
 }
@@ -0,0 +1,306 @@
+package scramPkg
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// samRecord is a struct comprising a single read placement for SAM / BAM output
+type samRecord struct {
+	Name   string      // Name is the read name (srna_<n>, numbered in output order)
+	RefID  int         // RefID is the index of the reference sequence in the ref slice
+	Pos    int         // Pos is the aligned read position (from 5' fwd, starting at 1)
+	Flag   int         // Flag is 16 for an antisense alignment, plus 256 for a secondary alignment
+	MapQ   int         // MapQ is the mapping quality, from the no. of times the read has aligned
+	Seq    string      // Seq is the read sequence in the fwd orientation of the reference
+	NH     int         // NH is the no. of times the read has aligned
+	Counts interface{} // Counts is the *meanSe or *[]float64 for the read (NOT split)
+}
+
+// samRecords generates SAM records for an alignment map, sorted by reference (in ref slice order) and position.  The
+// first placement of each read in that order is the primary alignment, and the rest are secondary.
+func samRecords(alignmentMap map[string]map[string][]int, seqMap map[string]interface{},
+	refSlice []*HeaderRef) []*samRecord {
+	profileAlignmentsMap := ProfileNoSplit(alignmentMap, seqMap)
+	readNames := make(map[string]string)
+	var records []*samRecord
+	for refID, ref := range refSlice {
+		alignments, ok := profileAlignmentsMap[ref.Header]
+		if !ok {
+			continue
+		}
+		var refRecords []*samRecord
+		for _, alignment := range *alignments.(*singleAlignments) {
+			record := &samRecord{RefID: refID, Pos: alignment.Pos, Seq: alignment.Seq,
+				MapQ: samMapQ(alignment.timesAligned), NH: alignment.timesAligned, Counts: alignment.Alignments}
+			if alignment.Strand == "-" {
+				record.Flag = 16
+				record.Seq = reverseComplement(alignment.Seq)
+			}
+			refRecords = append(refRecords, record)
+		}
+		sort.Slice(refRecords, func(i, j int) bool {
+			switch {
+			case refRecords[i].Pos != refRecords[j].Pos:
+				return refRecords[i].Pos < refRecords[j].Pos
+			case refRecords[i].Flag != refRecords[j].Flag:
+				return refRecords[i].Flag < refRecords[j].Flag
+			}
+			return refRecords[i].Seq < refRecords[j].Seq
+		})
+		for _, record := range refRecords {
+			read := record.Seq
+			if record.Flag&16 != 0 {
+				read = reverseComplement(record.Seq)
+			}
+			if _, ok := readNames[read]; ok {
+				record.Flag |= 256
+			} else {
+				readNames[read] = "srna_" + strconv.Itoa(len(readNames)+1)
+			}
+			record.Name = readNames[read]
+		}
+		records = append(records, refRecords...)
+	}
+	return records
+}
+
+// samMapQ returns the mapping quality for a read that aligns nh times - 255 (unavailable) for a unique alignment,
+// otherwise -10 log10 of the probability that the placement is wrong (3 for 2 placements, 1 for 3-4, 0 for more)
+func samMapQ(nh int) int {
+	if nh <= 1 {
+		return 255
+	}
+	return int(-10 * math.Log10(1-1/float64(nh)))
+}
+
+// samRefName replaces characters that aren't permitted in a SAM reference name with an underscore
+func samRefName(header string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r <= ' ' || r > '~' || strings.ContainsRune("\\,\"'`()[]{}<>", r):
+			return '_'
+		}
+		return r
+	}, header)
+}
+
+// samHeaderText generates the SAM header text, with an @SQ line for each reference sequence
+func samHeaderText(refSlice []*HeaderRef) string {
+	var header bytes.Buffer
+	header.WriteString("@HD\tVN:1.6\tSO:coordinate\n")
+	for _, ref := range refSlice {
+		header.WriteString("@SQ\tSN:" + samRefName(ref.Header) + "\tLN:" + strconv.Itoa(len(ref.Seq)) + "\n")
+	}
+	header.WriteString("@PG\tID:scram2\tPN:scram2\n")
+	return header.String()
+}
+
+// AlignmentsToSam writes the alignments for reads of length nt to a SAM file.  There is one record per read placement,
+// with the first placement of each read as the primary alignment and the rest flagged as secondary (0x100).
+// Read counts are NOT split and are stored in the XC tag (XC:f mean and XE:f standard error, or an XC:B:f array of
+// individual counts), with the no. of times the read aligns in the NH tag.
+func AlignmentsToSam(alignmentMap map[string]map[string][]int, seqMap map[string]interface{},
+	refSlice []*HeaderRef, nt int, outPrefix string) {
+	outFile := outPrefix + "_" + strconv.Itoa(nt) + ".sam"
+	f := createOutFile(outFile)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	w.WriteString(samHeaderText(refSlice))
+	for _, record := range samRecords(alignmentMap, seqMap, refSlice) {
+		fields := []string{record.Name, strconv.Itoa(record.Flag), samRefName(refSlice[record.RefID].Header),
+			strconv.Itoa(record.Pos), strconv.Itoa(record.MapQ), strconv.Itoa(len(record.Seq)) + "M", "*", "0", "0", record.Seq, "*",
+			"NH:i:" + strconv.Itoa(record.NH)}
+		switch v := record.Counts.(type) {
+		case *meanSe:
+			fields = append(fields, "XC:f:"+strconv.FormatFloat(v.Mean, 'f', 3, 64),
+				"XE:f:"+strconv.FormatFloat(v.Se, 'f', 8, 64))
+		case *[]float64:
+			counts := "XC:B:f"
+			for _, count := range *v {
+				counts += "," + strconv.FormatFloat(count, 'f', 3, 64)
+			}
+			fields = append(fields, counts)
+		}
+		w.WriteString(strings.Join(fields, "\t") + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalln("error writing sam:", err)
+	}
+}
+
+// AlignmentsToBam writes the alignments for reads of length nt to a BGZF compressed BAM file.  Records and tags are
+// as for AlignmentsToSam.  The file is coordinate sorted but not indexed.
+func AlignmentsToBam(alignmentMap map[string]map[string][]int, seqMap map[string]interface{},
+	refSlice []*HeaderRef, nt int, outPrefix string) {
+	outFile := outPrefix + "_" + strconv.Itoa(nt) + ".bam"
+	f := createOutFile(outFile)
+	defer f.Close()
+	w := newBgzfWriter(f)
+
+	var header bytes.Buffer
+	headerText := samHeaderText(refSlice)
+	header.WriteString("BAM\x01")
+	binary.Write(&header, binary.LittleEndian, int32(len(headerText)))
+	header.WriteString(headerText)
+	binary.Write(&header, binary.LittleEndian, int32(len(refSlice)))
+	for _, ref := range refSlice {
+		name := samRefName(ref.Header)
+		binary.Write(&header, binary.LittleEndian, int32(len(name)+1))
+		header.WriteString(name + "\x00")
+		binary.Write(&header, binary.LittleEndian, int32(len(ref.Seq)))
+	}
+	w.Write(header.Bytes())
+
+	for _, record := range samRecords(alignmentMap, seqMap, refSlice) {
+		w.Write(bamRecord(record))
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalln("error writing bam:", err)
+	}
+}
+
+// bamRecord encodes a single SAM record in the BAM binary format
+func bamRecord(record *samRecord) []byte {
+	var body bytes.Buffer
+	seqLen := len(record.Seq)
+	beg := record.Pos - 1
+	fixed := []interface{}{
+		int32(record.RefID), int32(beg), uint8(len(record.Name) + 1), uint8(record.MapQ),
+		uint16(reg2bin(beg, beg+seqLen)), uint16(1), uint16(record.Flag), int32(seqLen),
+		int32(-1), int32(-1), int32(0)}
+	for _, field := range fixed {
+		binary.Write(&body, binary.LittleEndian, field)
+	}
+	body.WriteString(record.Name + "\x00")
+	binary.Write(&body, binary.LittleEndian, uint32(seqLen<<4))
+	body.Write(packBamSeq(record.Seq))
+	body.Write(bytes.Repeat([]byte{0xff}, seqLen))
+
+	body.WriteString("NHi")
+	binary.Write(&body, binary.LittleEndian, int32(record.NH))
+	switch v := record.Counts.(type) {
+	case *meanSe:
+		body.WriteString("XCf")
+		binary.Write(&body, binary.LittleEndian, float32(v.Mean))
+		body.WriteString("XEf")
+		binary.Write(&body, binary.LittleEndian, float32(v.Se))
+	case *[]float64:
+		body.WriteString("XCBf")
+		binary.Write(&body, binary.LittleEndian, int32(len(*v)))
+		for _, count := range *v {
+			binary.Write(&body, binary.LittleEndian, float32(count))
+		}
+	}
+
+	var bamRecord bytes.Buffer
+	binary.Write(&bamRecord, binary.LittleEndian, int32(body.Len()))
+	bamRecord.Write(body.Bytes())
+	return bamRecord.Bytes()
+}
+
+// Packs a DNA sequence into 4-bit BAM encoding, 2 bases per byte
+func packBamSeq(seq string) []byte {
+	const bamBases = "=ACMGRSVTWYHKDBN"
+	packed := make([]byte, (len(seq)+1)/2)
+	for i := 0; i < len(seq); i++ {
+		code := strings.IndexByte(bamBases, seq[i])
+		if code < 0 {
+			code = 15
+		}
+		if i%2 == 0 {
+			packed[i/2] = byte(code << 4)
+		} else {
+			packed[i/2] |= byte(code)
+		}
+	}
+	return packed
+}
+
+// reg2bin calculates the BAM bin for a 0-based, end exclusive region (as per the SAM specification)
+func reg2bin(beg int, end int) int {
+	end--
+	switch {
+	case beg>>14 == end>>14:
+		return ((1<<15)-1)/7 + (beg >> 14)
+	case beg>>17 == end>>17:
+		return ((1<<12)-1)/7 + (beg >> 17)
+	case beg>>20 == end>>20:
+		return ((1<<9)-1)/7 + (beg >> 20)
+	case beg>>23 == end>>23:
+		return ((1<<6)-1)/7 + (beg >> 23)
+	case beg>>26 == end>>26:
+		return ((1<<3)-1)/7 + (beg >> 26)
+	}
+	return 0
+}
+
+// bgzfMaxBlock is the max. no. of uncompressed bytes in a BGZF block, leaving room for incompressible data
+const bgzfMaxBlock = 0xff00
+
+// bgzfEOF is the empty BGZF block that marks the end of a BGZF file
+var bgzfEOF = []byte{0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43, 0x02,
+	0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+// bgzfWriter writes BGZF (blocked gzip) compressed data, as required for BAM files
+type bgzfWriter struct {
+	w   io.Writer
+	buf []byte
+	err error
+}
+
+func newBgzfWriter(w io.Writer) *bgzfWriter {
+	return &bgzfWriter{w: w}
+}
+
+// Write buffers data, writing a compressed block each time a full block of data is available
+func (bw *bgzfWriter) Write(p []byte) (int, error) {
+	bw.buf = append(bw.buf, p...)
+	for len(bw.buf) >= bgzfMaxBlock && bw.err == nil {
+		bw.writeBlock(bw.buf[:bgzfMaxBlock])
+		bw.buf = bw.buf[bgzfMaxBlock:]
+	}
+	return len(p), bw.err
+}
+
+// Close writes any buffered data and the BGZF EOF block
+func (bw *bgzfWriter) Close() error {
+	if len(bw.buf) > 0 && bw.err == nil {
+		bw.writeBlock(bw.buf)
+		bw.buf = nil
+	}
+	if bw.err == nil {
+		_, bw.err = bw.w.Write(bgzfEOF)
+	}
+	return bw.err
+}
+
+// writeBlock compresses and writes a single BGZF block
+func (bw *bgzfWriter) writeBlock(data []byte) {
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+	fw.Write(data)
+	if err := fw.Close(); err != nil {
+		bw.err = err
+		return
+	}
+	var block bytes.Buffer
+	block.Write([]byte{0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43, 0x02, 0x00})
+	binary.Write(&block, binary.LittleEndian, uint16(compressed.Len()+25))
+	block.Write(compressed.Bytes())
+	binary.Write(&block, binary.LittleEndian, crc32.ChecksumIEEE(data))
+	binary.Write(&block, binary.LittleEndian, uint32(len(data)))
+	if _, err := bw.w.Write(block.Bytes()); err != nil {
+		bw.err = fmt.Errorf("writing bgzf block: %v", err)
+	}
+}
@@ -1,11 +1,28 @@
 package scramPkg
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/montanaflynn/stats"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSeqLoad_single(t *testing.T) {
@@ -173,9 +190,9 @@ func TestSeqLoad_multi_minCount(t *testing.T) {
 func TestRefLoad(t *testing.T) {
 	test_ref := RefLoad("./test_data/test_ref.fa")
 	var should_be []*HeaderRef
-	ref1 := &HeaderRef{"ref_1", "AAAAAAAAAAAAAAAAAAAAAAAAA", "TTTTTTTTTTTTTTTTTTTTTTTTT"}
-	ref2 := &HeaderRef{"ref_2", "GGGGGGGGGGGGGGGGGGGGGGGGTAAAAAAAAAAAAAAAAAAAAAAAAG", "CTTTTTTTTTTTTTTTTTTTTTTTTACCCCCCCCCCCCCCCCCCCCCCCC"}
-	ref3 := &HeaderRef{"ref_3", "", ""}
+	ref1 := &HeaderRef{"ref_1", "AAAAAAAAAAAAAAAAAAAAAAAAA", "TTTTTTTTTTTTTTTTTTTTTTTTT", "ref_1", ""}
+	ref2 := &HeaderRef{"ref_2", "GGGGGGGGGGGGGGGGGGGGGGGGTAAAAAAAAAAAAAAAAAAAAAAAAG", "CTTTTTTTTTTTTTTTTTTTTTTTTACCCCCCCCCCCCCCCCCCCCCCCC", "ref_2", ""}
+	ref3 := &HeaderRef{"ref_3", "", "", "ref_3", ""}
 	should_be = append(should_be, ref1, ref2, ref3)
 	fmt.Println(test_ref)
 	if len(test_ref) != len(should_be) {
@@ -193,6 +210,10 @@ func TestRefLoad(t *testing.T) {
 			t.Error("Seqs dont't match")
 		}
 	}
+	test_ref = RefLoad("./test_data/test_ref_nameless.fa")
+	if len(test_ref) != 2 || test_ref[0].Header != "" || test_ref[1].Header != "ref_2" {
+		t.Error("A nameless reference header is not loaded")
+	}
 }
 
 func TestAlign(t *testing.T) {
@@ -515,3 +536,1076 @@ func TestIndvMirAlign(t *testing.T) {
 		t.Error("split mir alignments are not equal")
 	}
 }
+
+func TestCompareRefStats(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_ref_align.fa")
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_seq_1.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_align := AlignReads(test_seq, test_ref, 24)
+	test_stats := CompareRefStats(test_align, test_seq, test_ref)
+	should_be := map[string]*RefStats{
+		"ref_1": {25, 1, 1.0, 0.0, 1.0, map[int]float64{24: 1000000}},
+		"ref_2": {50, 2, 0.96, 0.0, 1.0, map[int]float64{24: 750000}},
+		"ref_3": {25, 1, 0.0, 1.0, 0.0, map[int]float64{24: 1000000}},
+	}
+	eq := reflect.DeepEqual(test_stats, should_be)
+	if eq == false {
+		for header, single_stats := range test_stats {
+			fmt.Println(header, single_stats)
+		}
+		t.Error("Ref stats are not equal")
+	}
+}
+
+func TestProfileCoverage(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_ref_align.fa")
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_seq_1.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_align := AlignReads(test_seq, test_ref, 24)
+	test_cov := ProfileCoverage(ProfileNoSplit(test_align, test_seq), test_ref)
+
+	fwd_depth := make([]float64, 50)
+	for pos := 0; pos < 24; pos++ {
+		fwd_depth[pos] = 250000
+		fwd_depth[pos+25] = 500000
+	}
+	should_be := &CoverageProfile{50, true, [][]float64{fwd_depth, make([]float64, 50)},
+		[][]float64{make([]float64, 50), make([]float64, 50)}}
+	if !reflect.DeepEqual(test_cov["ref_2"], should_be) {
+		fmt.Println(test_cov["ref_2"])
+		t.Error("Coverage profile is incorrect")
+	}
+
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	CoverageToBedGraph(test_cov, test_ref, 24, out_prefix)
+	bedgraph, _ := ioutil.ReadFile(out_prefix + "_24_fwd.bedgraph")
+	should_be_bedgraph := "track type=bedGraph name=\"test_24_fwd\"\n" +
+		"ref_1\t0\t1\t500000.000\nref_1\t1\t24\t1000000.000\nref_1\t24\t25\t500000.000\n" +
+		"ref_2\t0\t24\t250000.000\nref_2\t25\t49\t500000.000\n"
+	if string(bedgraph) != should_be_bedgraph {
+		fmt.Println(string(bedgraph))
+		t.Error("bedGraph output is incorrect")
+	}
+
+	CoverageToCsv(test_cov, test_ref, 24, out_prefix, nil)
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_24_coverage.csv")
+	csv_lines := strings.Split(strings.TrimSpace(string(csv_data)), "\n")
+	if len(csv_lines) != 101 || csv_lines[0] != "Header,Position,Fwd depth,Fwd std. err,Rvs depth,Rvs std. err" ||
+		csv_lines[52] != "ref_2,27,500000.000,0.00000000,0.000,0.00000000" {
+		fmt.Println(string(csv_data))
+		t.Error("Coverage csv output is incorrect")
+	}
+}
+
+func TestAlignmentsToSamBam(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_ref_align.fa")
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_seq_1.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_align := AlignReads(test_seq, test_ref, 24)
+
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	AlignmentsToSam(test_align, test_seq, test_ref, 24, out_prefix)
+	sam, _ := ioutil.ReadFile(out_prefix + "_24.sam")
+	sam_lines := strings.Split(strings.TrimSpace(string(sam)), "\n")
+	if len(sam_lines) != 11 || sam_lines[1] != "@SQ\tSN:ref_1\tLN:25" {
+		fmt.Println(string(sam))
+		t.Error("SAM header is incorrect")
+	}
+	should_be_record := "srna_1\t272\tref_3\t1\t0\t24M\t*\t0\t0\tTTTTTTTTTTTTTTTTTTTTTTTT\t*\t" +
+		"NH:i:5\tXC:f:500000.000\tXE:f:0.00000000"
+	if sam_lines[9] != should_be_record {
+		fmt.Println(sam_lines[9])
+		t.Error("SAM record is incorrect")
+	}
+	primaries := make(map[string]int)
+	for _, line := range sam_lines[5:] {
+		fields := strings.Split(line, "\t")
+		if flag, _ := strconv.Atoi(fields[1]); flag&256 == 0 {
+			primaries[fields[0]]++
+		}
+	}
+	if !reflect.DeepEqual(primaries, map[string]int{"srna_1": 1, "srna_2": 1}) {
+		fmt.Println(string(sam))
+		t.Error("SAM reads should have one primary alignment each", primaries)
+	}
+
+	AlignmentsToBam(test_align, test_seq, test_ref, 24, out_prefix)
+	bam, _ := ioutil.ReadFile(out_prefix + "_24.bam")
+	gz, err := gzip.NewReader(bytes.NewReader(bam))
+	if err != nil {
+		t.Fatal("BAM is not BGZF compressed")
+	}
+	bam_data, err := ioutil.ReadAll(gz)
+	if err != nil || !bytes.HasPrefix(bam_data, []byte("BAM\x01")) {
+		t.Fatal("BAM magic is incorrect")
+	}
+	l_text := int(binary.LittleEndian.Uint32(bam_data[4:8]))
+	if string(bam_data[8:8+l_text]) != strings.Join(sam_lines[:5], "\n")+"\n" {
+		t.Error("BAM header text is incorrect")
+	}
+}
+
+func TestProfileToBedGff(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_ref_align.fa")
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_seq_1.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_align := AlignReads(test_seq, test_ref, 24)
+	test_profile := ProfileSplit(test_align, test_seq)
+
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	ProfileToBed(test_profile, test_ref, 24, out_prefix, false)
+	bed, _ := ioutil.ReadFile(out_prefix + "_24.bed")
+	bed_lines := strings.Split(strings.TrimSpace(string(bed)), "\n")
+	if len(bed_lines) != 6 || bed_lines[3] != "ref_2\t25\t49\tAAAAAAAAAAAAAAAAAAAAAAAA\t400\t+\t100000.000" {
+		fmt.Println(string(bed))
+		t.Error("BED output is incorrect")
+	}
+
+	ProfileToGff(test_profile, test_ref, 24, out_prefix)
+	gff, _ := ioutil.ReadFile(out_prefix + "_24.gff3")
+	gff_lines := strings.Split(strings.TrimSpace(string(gff)), "\n")
+	should_be := "ref_3\tscram2\tsRNA\t2\t25\t100000.000\t-\t.\t" +
+		"ID=srna_aln_6;Name=AAAAAAAAAAAAAAAAAAAAAAAA;count=100000.000;se=0.00000000;times_aligned=5"
+	if len(gff_lines) != 10 || gff_lines[9] != should_be {
+		fmt.Println(string(gff))
+		t.Error("GFF3 output is incorrect")
+	}
+}
+
+func TestCompareFeatureCounts(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_ref_align.fa")
+	test_features := AnnotationLoad("./test_data/test_annotation.gff3",
+		[]string{"gene", "transposable_element", "tRNA"})
+	if len(test_features) != 4 {
+		t.Error("Wrong no of features in test_annotation.gff3")
+	}
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_seq_1.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_align := AlignReads(test_seq, test_ref, 24)
+
+	sense_counts := CompareFeatureCounts(test_align, test_seq, test_features, "sense", false)
+	should_be_sense := map[string]interface{}{"gene1": meanSe{750000, 0}, "trna1": meanSe{1000000, 0}}
+	if !reflect.DeepEqual(sense_counts, should_be_sense) {
+		fmt.Println(sense_counts)
+		t.Error("Sense feature counts are incorrect")
+	}
+	antisense_counts := CompareFeatureCounts(test_align, test_seq, test_features, "antisense", true)
+	should_be_antisense := map[string]interface{}{"gene2": meanSe{100000, 0}, "te1": meanSe{200000, 0},
+		"trna1": meanSe{200000, 0}}
+	if !reflect.DeepEqual(antisense_counts, should_be_antisense) {
+		fmt.Println(antisense_counts)
+		t.Error("Antisense split feature counts are incorrect")
+	}
+}
+
+func TestFindLoci(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_ref_align.fa")
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_seq_1.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_align := MergeAlignments(AlignReads(test_seq, test_ref, 24), AlignReads(test_seq, test_ref, 21))
+
+	test_loci := FindLoci(test_align, test_seq, 1, 0.0, false)
+	should_be := []*Locus{
+		{"ref_1", 1, 25, meanSe{1000000, 0}, 1000000, 1, 2, 24, 1.0, 1.0 / 1000000, 0.0},
+		{"ref_2", 1, 49, meanSe{750000, 0}, 750000, 2, 2, 24, 1.0, 2.0 / 750000, 0.0},
+		{"ref_3", 1, 25, meanSe{1000000, 0}, 1000000, 1, 2, 24, 0.0, 1.0 / 1000000, 0.0},
+	}
+	if !reflect.DeepEqual(test_loci, should_be) {
+		for _, i := range test_loci {
+			fmt.Println(i)
+		}
+		t.Error("Loci are incorrect")
+	}
+	if len(FindLoci(test_align, test_seq, 0, 0.0, false)) != 4 {
+		t.Error("Loci should not be merged across a gap")
+	}
+
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	LociToBed(test_loci, out_prefix)
+	bed, _ := ioutil.ReadFile(out_prefix + "_loci.bed")
+	bed_lines := strings.Split(strings.TrimSpace(string(bed)), "\n")
+	if len(bed_lines) != 3 || bed_lines[1] != "ref_2\t0\t49\tlocus_2\t750\t.\t750000.000" {
+		fmt.Println(string(bed))
+		t.Error("Loci BED output is incorrect")
+	}
+	LociToGff(test_loci, out_prefix)
+	gff, _ := ioutil.ReadFile(out_prefix + "_loci.gff3")
+	gff_lines := strings.Split(strings.TrimSpace(string(gff)), "\n")
+	if len(gff_lines) != 4 || gff_lines[3] != "ref_3\tscram2\tbiological_region\t1\t25\t1000000.000\t.\t.\t"+
+		"ID=locus_3;unique_reads=1;reads=2;dominant_length=24;strand_bias=0.000;complexity=1e-06;phase_score=0.000" {
+		fmt.Println(string(gff))
+		t.Error("Loci GFF3 output is incorrect")
+	}
+
+	// reads that also align to another reference are split for the phase score too
+	phased_seq := make(map[string]interface{})
+	phased_align := map[string]map[string][]int{"ref_a": {}, "ref_b": {}}
+	for i, pos := range []int{1, 22, 43} {
+		srna := strings.Repeat("ACGT"[i:i+1], 21)
+		phased_seq[srna] = &meanSe{10, 0}
+		phased_align["ref_a"][srna] = []int{pos}
+		phased_align["ref_b"][srna] = []int{pos}
+	}
+	split_loci := FindLoci(phased_align, phased_seq, 100, 0.0, true)
+	if len(split_loci) != 2 || math.Abs(split_loci[0].PhaseScore-math.Log(151)) > 1e-9 {
+		t.Error("Locus phase score does not use split counts")
+	}
+
+	phased := []phasedRead{newPhasedRead(1, "+", 10), newPhasedRead(22, "+", 10), newPhasedRead(43, "+", 10),
+		newPhasedRead(62, "-", 10)}
+	score, register := phaseScore(phased, 21)
+	if math.Abs(score-2*math.Log(401)) > 1e-9 || register != 0 {
+		t.Error("Phase score is incorrect", score, register)
+	}
+}
+
+func TestPhasedWindows(t *testing.T) {
+	test_ref := []*HeaderRef{{"ref_1", strings.Repeat("A", 200), strings.Repeat("T", 200), "ref_1", ""}}
+	var test_alignments singleAlignments
+	for _, pos := range []int{1, 22, 43, 10} {
+		test_alignments = append(test_alignments, &singleAlignment{strings.Repeat("A", 21), 1, pos, "+",
+			&meanSe{10, 0}})
+	}
+	test_alignments = append(test_alignments, &singleAlignment{strings.Repeat("T", 21), 1, 62, "-",
+		&meanSe{10, 0}})
+	test_profile := map[string]interface{}{"ref_1": &test_alignments}
+
+	test_windows := PhasedWindows(test_profile, test_ref, 21, 4, 21, 1.0)
+	if len(test_windows) != 2 || test_windows[1].Start != 22 {
+		t.Fatal("Wrong no. of phased windows", len(test_windows))
+	}
+	window := test_windows[0]
+	if window.Start != 1 || window.End != 84 || window.Register != 1 || window.PhasedAbundance != 40 ||
+		window.TotalAbundance != 50 || math.Abs(window.PhaseScore-2*math.Log(1+400.0/11.0)) > 1e-9 {
+		fmt.Println(window)
+		t.Error("Phased window is incorrect")
+	}
+	should_be_p := math.Exp(logChoose(8, 4)+logChoose(160, 1)-logChoose(168, 5)) +
+		math.Exp(logChoose(8, 5)-logChoose(168, 5))
+	if math.Abs(window.PValue-should_be_p) > 1e-12 {
+		t.Error("Phased window p-value is incorrect", window.PValue, should_be_p)
+	}
+	test_ref = []*HeaderRef{{"ref_1", strings.Repeat("A", 70), strings.Repeat("T", 70), "ref_1", ""}}
+	test_windows = PhasedWindows(test_profile, test_ref, 21, 4, 21, 1.0)
+	if len(test_windows) != 1 || test_windows[0].Start != 1 || test_windows[0].End != 70 {
+		t.Error("Phased window on a short reference is incorrect", len(test_windows))
+	}
+}
+
+func TestAlignIsomirs(t *testing.T) {
+	test_mir_ref := MirLoad("./test_data/test_isomir_mature.fa")
+	test_hairpins, _ := HairpinLoad("./test_data/test_isomir_hairpin.fa")
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_isomir_reads.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 15, 32, 1.0, true)
+	test_isomirs := AlignIsomirs(test_seq, test_mir_ref, test_hairpins, 3, 3)
+	if len(test_isomirs) != 1 || len(test_isomirs["mir_a"]) != 5 {
+		t.Fatal("Wrong no. of isomiRs")
+	}
+	should_be := []struct {
+		class    string
+		shift5   int
+		shift3   int
+		addition string
+		subs     string
+	}{
+		{"5'shift", 1, 0, "", ""},
+		{"3'trim", 0, -2, "", ""},
+		{"canonical", 0, 0, "", ""},
+		{"3'NTA", 0, 0, "TT", ""},
+		{"substitution", 0, 0, "", "10:A>C"},
+	}
+	for i, iso := range test_isomirs["mir_a"] {
+		if iso.Class() != should_be[i].class || iso.Shift5 != should_be[i].shift5 ||
+			iso.Shift3 != should_be[i].shift3 || iso.Addition != should_be[i].addition ||
+			strings.Join(iso.Substitutions, ";") != should_be[i].subs || iso.Hairpin != "hp_1" {
+			fmt.Println(iso)
+			t.Error("isomiR is incorrectly classified")
+		}
+	}
+	test_counts := IsomirCounts(test_isomirs, true)
+	if !reflect.DeepEqual(test_counts, map[string]interface{}{"mir_a": meanSe{139, 0}}) {
+		fmt.Println(test_counts)
+		t.Error("isomiR counts are incorrect")
+	}
+
+	// mir_a is in both hairpins, so its isomiRs are attributed to the first by header
+	two_hairpins, descriptions := HairpinLoad("./test_data/test_precursor_hairpin.fa")
+	if descriptions["hp_2"] != "MI0000002 Test hp_2 stem-loop" {
+		t.Error("Hairpin descriptions are incorrect", descriptions)
+	}
+	for i := 0; i < 10; i++ {
+		for _, iso := range AlignIsomirs(test_seq, test_mir_ref, two_hairpins, 3, 3)["mir_a"] {
+			if iso.Hairpin != "hp_1" {
+				t.Fatal("isomiR is attributed to the wrong hairpin", iso.Hairpin)
+			}
+		}
+	}
+}
+
+func TestPrecursorQuant(t *testing.T) {
+	test_precursors := PrecursorLoad("./test_data/test_precursor_hairpin.fa", "./test_data/test_mirbase.gff3", nil)
+	should_be_arms := map[string][]*MatureArm{
+		"hp_1": {{"mir_a", "5p", 6, 28}, {"mir_b", "3p", 44, 66}},
+		"hp_2": {{"mir_a", "5p", 4, 26}},
+	}
+	for name, arms := range should_be_arms {
+		if !reflect.DeepEqual(test_precursors[name].Arms, arms) {
+			t.Error("Mature arms are incorrect for " + name)
+		}
+	}
+	seq_precursors := PrecursorLoad("./test_data/test_precursor_hairpin.fa", "",
+		MirLoad("./test_data/test_isomir_mature.fa"))
+	if !reflect.DeepEqual(seq_precursors["hp_1"].Arms, should_be_arms["hp_1"]) {
+		t.Error("Mature arms located by sequence are incorrect")
+	}
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_precursor_reads.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 15, 32, 1.0, true)
+	test_counts := PrecursorQuant(test_seq, test_precursors, true)
+	should_be := map[string]*PrecursorCounts{
+		"hp_1": {should_be_arms["hp_1"][0], should_be_arms["hp_1"][1], meanSe{50, 0}, meanSe{3, 0}, meanSe{7, 0},
+			meanSe{}, 10, 50},
+		"hp_2": {should_be_arms["hp_2"][0], nil, meanSe{50, 0}, meanSe{}, meanSe{}, meanSe{}, 0, 50},
+	}
+	if !reflect.DeepEqual(test_counts, should_be) {
+		for name, counts := range test_counts {
+			fmt.Println(name, counts)
+		}
+		t.Error("Precursor counts are incorrect")
+	}
+}
+
+func TestMirLoadWithOptions(t *testing.T) {
+	test_mir_ref := MirLoadWithOptions("./test_data/test_mir_species.fa", &MirOptions{Prefixes: []string{"ath"}})
+	should_be := map[string]*mirnaSeqDup{
+		"ath-miR156a-5p": {"TGACAGAAGAGAGTGAGCAC", 2, "MIMAT0000166", "MIMAT0000166 Arabidopsis thaliana miR156a-5p"},
+		"ath-miR156b-5p": {"TGACAGAAGAGAGTGAGCAC", 2, "MIMAT0000167", "MIMAT0000167 Arabidopsis thaliana miR156b-5p"},
+	}
+	if !reflect.DeepEqual(test_mir_ref, should_be) {
+		t.Error("miRNAs are not filtered by species prefix")
+	}
+	test_mir_ref = MirLoadWithOptions("./test_data/test_mir_species.fa",
+		&MirOptions{Organisms: []string{"Oryza sativa"}})
+	if len(test_mir_ref) != 1 || test_mir_ref["osa-miR156a"].dup != 1 {
+		t.Error("miRNAs are not filtered by organism")
+	}
+	test_mir_ref = MirLoadWithOptions("./test_data/test_mir_species.fa",
+		&MirOptions{Prefixes: []string{"hsa"}, AliasFile: "./test_data/test_mir_aliases.txt"})
+	accessions := MirnaAccessions(test_mir_ref)
+	if !reflect.DeepEqual(accessions, map[string]string{"hsa-let-7a-5p": "MIMAT0000062"}) {
+		fmt.Println(accessions)
+		t.Error("miRNA accession is not loaded from alias file")
+	}
+}
+
+func TestProfileToFile(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_ref_align.fa")
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_seq_1.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_align := AlignReads(test_seq, test_ref, 24)
+	test_profile := ProfileNoSplit(test_align, test_seq)
+
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	ProfileToCsv(test_profile, test_ref, 24, out_prefix, nil)
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_24.csv")
+	csv_lines := strings.Split(strings.TrimSpace(string(csv_data)), "\n")
+
+	ProfileToFile(test_profile, test_ref, 24, out_prefix, nil,
+		&OutputOptions{Format: "tsv", Precision: 3, SePrecision: 8, FloatFormat: 'f', Gzip: true})
+	gz_data, _ := ioutil.ReadFile(out_prefix + "_24.tsv.gz")
+	gz, err := gzip.NewReader(bytes.NewReader(gz_data))
+	if err != nil {
+		t.Fatal("TSV is not gzip compressed")
+	}
+	tsv_data, _ := ioutil.ReadAll(gz)
+	if strings.Replace(string(tsv_data), "\t", ",", -1) != string(csv_data) {
+		fmt.Println(string(tsv_data))
+		t.Error("TSV output is incorrect")
+	}
+
+	ProfileToFile(test_profile, test_ref, 24, out_prefix, nil,
+		&OutputOptions{Format: "jsonl", Precision: 1, SePrecision: 2, FloatFormat: 'f'})
+	jsonl_data, _ := ioutil.ReadFile(out_prefix + "_24.jsonl")
+	jsonl_lines := strings.Split(strings.TrimSpace(string(jsonl_data)), "\n")
+	should_be_line := "{\"Header\":\"ref_1\",\"len\":25,\"sRNA\":\"AAAAAAAAAAAAAAAAAAAAAAAA\",\"Position\":1," +
+		"\"Strand\":\"+\",\"Count\":500000.0,\"Std. Err\":0.00,\"Times aligned\":5}"
+	if len(jsonl_lines) != len(csv_lines)-1 || jsonl_lines[0] != should_be_line {
+		fmt.Println(string(jsonl_data))
+		t.Error("JSON Lines output is incorrect")
+	}
+
+	var jsonl_buf bytes.Buffer
+	jw, _ := NewRowWriter(&jsonl_buf, &OutputOptions{Format: "jsonl", Precision: 1, FloatFormat: 'f'})
+	jw.WriteHeader([]string{"a.fa", "a.fa", "a.fa_2", "a.fa"})
+	jw.WriteRow([]interface{}{1.0, 2.0, 3.0, 4.0})
+	jw.Close()
+	if jsonl_buf.String() != "{\"a.fa\":1.0,\"a.fa_3\":2.0,\"a.fa_2\":3.0,\"a.fa_4\":4.0}\n" {
+		fmt.Println(jsonl_buf.String())
+		t.Error("JSON Lines keys are not unique")
+	}
+
+	ProfileToFile(test_profile, test_ref, 24, out_prefix, nil, &OutputOptions{Format: "col", FloatFormat: 'f'})
+	col_data, _ := ioutil.ReadFile(out_prefix + "_24.scol")
+	columns, rows, err := ReadColumnar(bytes.NewReader(col_data))
+	should_be_columns := []string{"Header", "len", "sRNA", "Position", "Strand", "Count", "Std. Err",
+		"Times aligned"}
+	should_be_row := []interface{}{"ref_1", 25, "AAAAAAAAAAAAAAAAAAAAAAAA", 1, "+", 500000.0, 0.0, 5}
+	if err != nil || !reflect.DeepEqual(columns, should_be_columns) || len(rows) != len(csv_lines)-1 ||
+		!reflect.DeepEqual(rows[0], should_be_row) {
+		fmt.Println(columns, rows, err)
+		t.Error("Columnar output is incorrect")
+	}
+
+	if _, err := NewRowWriter(&bytes.Buffer{}, &OutputOptions{Format: "xml", FloatFormat: 'f'}); err == nil {
+		t.Error("Unknown output format should return an error")
+	}
+}
+
+// CompareToCsv used to drop the first mean/se row (the header row replaced it) and wrote rows in map order
+func TestCompareToCsvRows(t *testing.T) {
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	single := map[string]interface{}{"ref_1": compMeanSeOutput{[]float64{1, 0.5, 2, 0.25}}}
+	CompareToCsv(single, 24, out_prefix, nil, nil)
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_24.csv")
+	if string(csv_data) != "Header,Mean count 1,Std. err 1,Mean count 2,Std. err 2\n"+
+		"ref_1,1.000,0.50000000,2.000,0.25000000\n" {
+		fmt.Println(string(csv_data))
+		t.Error("First compare row is dropped")
+	}
+
+	multiple := make(map[string]interface{})
+	for _, header := range []string{"ref_c", "ref_a", "ref_d", "ref_b"} {
+		multiple[header] = compMeanSeOutput{[]float64{1, 0, 1, 0}}
+	}
+	CompareToCsv(multiple, 24, out_prefix, nil, nil)
+	csv_data, _ = ioutil.ReadFile(out_prefix + "_24.csv")
+	var headers []string
+	for _, line := range strings.Split(strings.TrimSpace(string(csv_data)), "\n")[1:] {
+		headers = append(headers, strings.Split(line, ",")[0])
+	}
+	if !reflect.DeepEqual(headers, []string{"ref_a", "ref_b", "ref_c", "ref_d"}) {
+		fmt.Println(string(csv_data))
+		t.Error("Compare rows are not sorted by header")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("write failed")
+}
+
+func TestWriteCompare(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_ref_align.fa")
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_seq_1.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_align := AlignReads(test_seq, test_ref, 24)
+	test_counts := CompareSplitCounts(test_align, test_seq)
+	test_compare := Compare(test_counts, test_counts)
+
+	var buf bytes.Buffer
+	if err := WriteCompare(&buf, test_compare, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	should_be := "Header,Mean count 1,Std. err 1,Mean count 2,Std. err 2\n" +
+		"ref_1,200000.000,0.00000000,200000.000,0.00000000\n" +
+		"ref_2,350000.000,0.00000000,350000.000,0.00000000\n" +
+		"ref_3,200000.000,0.00000000,200000.000,0.00000000\n"
+	if buf.String() != should_be {
+		fmt.Println(buf.String())
+		t.Error("Compare output is incorrect")
+	}
+
+	if err := WriteCompare(failingWriter{}, test_compare, nil, nil, nil); err == nil {
+		t.Error("Write error should be returned")
+	}
+
+	out_dir := t.TempDir()
+	out_prefix := filepath.Join(out_dir, "test")
+	if err := CompareToFile(test_compare, 24, out_prefix, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_24.csv")
+	if string(csv_data) != should_be {
+		t.Error("Compare file output is incorrect")
+	}
+	// output files get the same permissions (after the umask) as a file created with os.Create
+	created, _ := os.Create(filepath.Join(out_dir, "created.csv"))
+	created.Close()
+	created_info, err := os.Stat(created.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out_info, err := os.Stat(out_prefix + "_24.csv"); err != nil || out_info.Mode() != created_info.Mode() {
+		t.Fatal("Output file mode is incorrect", err)
+	}
+	os.Remove(created.Name())
+	err = CompareToFile(test_compare, 24, out_prefix, nil, nil, &OutputOptions{Format: "xml", FloatFormat: 'f'})
+	out_files, _ := ioutil.ReadDir(out_dir)
+	if err == nil || len(out_files) != 1 {
+		t.Error("Failed write should return an error and leave no partial file")
+	}
+}
+
+var bench_alignments = flag.Int("bench_alignments", 10000000, "no. of alignments in the profile output benchmarks")
+
+// Generates a profile of n alignments spread over 1000 reference sequences
+func benchProfile(n int) (map[string]interface{}, []*HeaderRef) {
+	bases := "ACGT"
+	var srnas []string
+	var counts []*meanSe
+	for i := 0; i < 1000; i++ {
+		srna := make([]byte, 24)
+		for j := range srna {
+			srna[j] = bases[(i>>uint(j%5*2))%4]
+		}
+		srnas = append(srnas, string(srna))
+		counts = append(counts, &meanSe{float64(i), float64(i) / 100})
+	}
+	profile := make(map[string]interface{})
+	var refs []*HeaderRef
+	refLen := n/1000 + 24
+	for i := 0; i < 1000; i++ {
+		header := "ref_" + strconv.Itoa(i)
+		refs = append(refs, &HeaderRef{Header: header, Seq: strings.Repeat("A", refLen)})
+		alignments := make(singleAlignments, 0, n/1000)
+		for pos := 1; pos <= n/1000; pos++ {
+			alignments = append(alignments, &singleAlignment{srnas[pos%1000], 1, pos, "+", counts[pos%1000]})
+		}
+		profile[header] = &alignments
+	}
+	return profile, refs
+}
+
+// Runs f and returns the peak heap size above the starting heap size, sampled every 10 ms.  The GC target is reduced
+// while f runs so that the peak reflects memory retained by f rather than uncollected garbage.
+func peakHeap(f func()) uint64 {
+	defer debug.SetGCPercent(debug.SetGCPercent(1))
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	base := m.HeapAlloc
+	peak := base
+	done := make(chan bool)
+	sampled := make(chan bool)
+	go func() {
+		var m runtime.MemStats
+		for {
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peak {
+				peak = m.HeapAlloc
+			}
+			select {
+			case <-done:
+				sampled <- true
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	f()
+	done <- true
+	<-sampled
+	return peak - base
+}
+
+func benchmarkProfileOutput(b *testing.B, write func(profile map[string]interface{}, refs []*HeaderRef)) {
+	profile, refs := benchProfile(*bench_alignments)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var peak uint64
+	for i := 0; i < b.N; i++ {
+		if p := peakHeap(func() { write(profile, refs) }); p > peak {
+			peak = p
+		}
+	}
+	b.ReportMetric(float64(peak)/(1<<20), "peak-MB")
+}
+
+func BenchmarkWriteProfileCsv(b *testing.B) {
+	benchmarkProfileOutput(b, func(profile map[string]interface{}, refs []*HeaderRef) {
+		WriteProfile(ioutil.Discard, profile, refs, nil, nil)
+	})
+}
+
+func BenchmarkWriteProfileColumnar(b *testing.B) {
+	benchmarkProfileOutput(b, func(profile map[string]interface{}, refs []*HeaderRef) {
+		WriteProfile(ioutil.Discard, profile, refs, nil, &OutputOptions{Format: "col", FloatFormat: 'f'})
+	})
+}
+
+// The previous ProfileToCsv approach - all rows are built as [][]string before writing - for comparison
+func BenchmarkWriteProfileCsvInMemory(b *testing.B) {
+	benchmarkProfileOutput(b, func(profile map[string]interface{}, refs []*HeaderRef) {
+		var rows [][]string
+		opts := DefaultOutputOptions()
+		profileRows(profile, refs, nil, func(columns []string, row []interface{}) error {
+			if rows == nil {
+				rows = append(rows, columns)
+			}
+			record := make([]string, len(row))
+			for i, value := range row {
+				record[i] = opts.formatValue(value)
+			}
+			rows = append(rows, record)
+			return nil
+		})
+		csv.NewWriter(ioutil.Discard).WriteAll(rows)
+	})
+}
+
+func TestReadComposition(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_ref_align.fa")
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_seq_1.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_align := MergeAlignments(AlignReads(test_seq, test_ref, 24), AlignReads(test_seq, test_ref, 21))
+
+	test_composition := ReadComposition(test_align, test_seq, 21, 24, false)
+	if len(test_composition) != 3 || len(test_composition["ref_2"]) != 32 {
+		t.Fatal("Read composition classes are incorrect")
+	}
+	should_be := map[ReadClass]meanSe{
+		{24, "A", "+"}: {500000, 0},
+		{24, "G", "+"}: {250000, 0},
+		{24, "A", "-"}: {0, 0},
+		{21, "G", "+"}: {0, 0},
+	}
+	for class, counts := range should_be {
+		if test_composition["ref_2"][class] != counts {
+			t.Error("Read composition is incorrect for", class, test_composition["ref_2"][class])
+		}
+	}
+	test_composition = ReadComposition(test_align, test_seq, 21, 24, true)
+	if test_composition["ref_3"][ReadClass{24, "A", "-"}] != (meanSe{200000, 0}) {
+		t.Error("Split read composition is incorrect")
+	}
+
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	ReadCompositionToCsv(test_composition, out_prefix, nil)
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_composition.csv")
+	csv_lines := strings.Split(strings.TrimSpace(string(csv_data)), "\n")
+	if len(csv_lines) != 97 || csv_lines[0] != "Header,Length,5' nt,Strand,Count,Std. Err" ||
+		csv_lines[1] != "ref_1,21,A,+,0.000,0.00000000" {
+		fmt.Println(string(csv_data))
+		t.Error("Read composition csv is incorrect")
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_pingpong_ref.fa")
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_pingpong_reads.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_align := MergeAlignments(AlignReads(test_seq, test_ref, 25), AlignReads(test_seq, test_ref, 22))
+	test_profile := ProfileNoSplit(test_align, test_seq)
+
+	test_ping_pong := PingPong(test_profile, 20)["ref_pp"]
+	should_be_overlaps := make([]float64, 20)
+	should_be_overlaps[1] = 600000.0 * 100000.0
+	should_be_overlaps[9] = 600000.0 * 300000.0
+	if !reflect.DeepEqual(test_ping_pong.Overlaps, should_be_overlaps) {
+		fmt.Println(test_ping_pong.Overlaps)
+		t.Error("Ping-pong overlaps are incorrect")
+	}
+	if math.Abs(test_ping_pong.ZScore-56.0/19.0*math.Sqrt(19)) > 1e-9 {
+		t.Error("Ping-pong Z-score is incorrect", test_ping_pong.ZScore)
+	}
+	if test_ping_pong.Frac1U != 0.9 || test_ping_pong.Frac10A != 1.0 {
+		t.Error("Ping-pong nucleotide bias is incorrect", test_ping_pong.Frac1U, test_ping_pong.Frac10A)
+	}
+
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	PingPongToCsv(PingPong(test_profile, 20), out_prefix)
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_pingpong.csv")
+	csv_lines := strings.Split(strings.TrimSpace(string(csv_data)), "\n")
+	if len(csv_lines) != 2 || !strings.HasPrefix(csv_lines[1], "ref_pp,12.847,0.900,1.000,0.000,60000000000.000,") {
+		fmt.Println(string(csv_data))
+		t.Error("Ping-pong csv is incorrect")
+	}
+}
+
+func TestDuplexSignature(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_pingpong_ref.fa")
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_duplex_reads.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_profile := ProfileNoSplit(AlignReads(test_seq, test_ref, 21), test_seq)
+
+	test_duplex := DuplexSignature(test_profile, 21)["ref_pp"]
+	should_be_overlaps := make([]float64, 21)
+	should_be_overlaps[10] = 500000.0 * 200000.0
+	should_be_overlaps[18] = 500000.0 * 300000.0
+	if !reflect.DeepEqual(test_duplex.Overlaps, should_be_overlaps) {
+		fmt.Println(test_duplex.Overlaps)
+		t.Error("Duplex overlaps are incorrect")
+	}
+	if math.Abs(test_duplex.ZScore-1.45*math.Sqrt(20)) > 1e-9 || math.Abs(test_duplex.Frequency-0.6) > 1e-9 {
+		t.Error("Duplex signature is incorrect", test_duplex.ZScore, test_duplex.Frequency)
+	}
+
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	DuplexToCsv(DuplexSignature(test_profile, 21), 21, out_prefix)
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_21_duplex.csv")
+	if !strings.HasPrefix(string(csv_data), "Header,Z-score (19 nt),Frequency (19 nt),Overlap 1,") {
+		fmt.Println(string(csv_data))
+		t.Error("Duplex csv is incorrect")
+	}
+}
+
+// Generates a profile for a 300 nt reference with 20 nt reads tiled every 20 nt and a hotspot read at 141
+func peakProfile(hotspot []float64) (map[string]interface{}, []*HeaderRef) {
+	read := strings.Repeat("A", 20)
+	var alignments singleAlignments
+	for pos := 1; pos < 300; pos += 20 {
+		alignments = append(alignments, &singleAlignment{read, 1, pos, "+", &[]float64{2, 2}})
+	}
+	alignments = append(alignments, &singleAlignment{read, 1, 141, "+", &hotspot})
+	profile := map[string]interface{}{"ref_1": &alignments}
+	return profile, []*HeaderRef{{Header: "ref_1", Seq: strings.Repeat("A", 300)}}
+}
+
+func TestCallPeaks(t *testing.T) {
+	test_profile, test_ref := peakProfile([]float64{60, 40})
+	test_peaks := CallPeaks(test_profile, test_ref, nil)
+	if len(test_peaks) != 1 {
+		t.Fatal("No. of peaks is incorrect", len(test_peaks))
+	}
+	test_peak := test_peaks[0]
+	if test_peak.Start != 141 || test_peak.End != 160 || test_peak.Strand != "+" || test_peak.Summit != 141 ||
+		test_peak.Height != 52 || test_peak.Replicates != 2 || test_peak.PValue > 1e-20 {
+		fmt.Println(*test_peak)
+		t.Error("Peak is incorrect")
+	}
+
+	test_profile, test_ref = peakProfile([]float64{60, 0})
+	if len(CallPeaks(test_profile, test_ref, nil)) != 0 {
+		t.Error("Peak should not pass in all replicates")
+	}
+	test_opts := DefaultPeakOptions()
+	test_opts.MinReplicates = 1
+	if test_peaks = CallPeaks(test_profile, test_ref, test_opts); len(test_peaks) != 1 || test_peaks[0].Replicates != 1 {
+		t.Error("Peak should pass in 1 replicate")
+	}
+
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	PeaksToCsv([]*Peak{{Header: "ref_1", Start: 141, End: 160, Strand: "+", Summit: 141, Height: 52,
+		Background: 2.5, PValue: 1.23456789e-30, Replicates: 2}}, out_prefix)
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_peaks.csv")
+	if !strings.HasSuffix(string(csv_data), "\nref_1,141,160,20,+,141,52,2.5,1.23457e-30,29.9085,2\n") {
+		fmt.Println(string(csv_data))
+		t.Error("Peaks csv output is incorrect")
+	}
+
+	if p := poissonUpperTail(3, 1); math.Abs(p-(1-math.Exp(-1)*2.5)) > 1e-12 {
+		t.Error("Poisson upper tail is incorrect", p)
+	}
+	if p := poissonUpperTail(1, 4); math.Abs(p-(1-math.Exp(-4))) > 1e-12 {
+		t.Error("Poisson upper tail is incorrect", p)
+	}
+}
+
+func TestBinProfile(t *testing.T) {
+	test_profile, test_ref := peakProfile([]float64{60, 40})
+	test_bins := BinProfile(test_profile, test_ref, 100, 50)["ref_1"]
+	if len(test_bins) != 5 || test_bins[4].Start != 201 || test_bins[4].End != 300 {
+		t.Fatal("Bins are incorrect")
+	}
+	if !reflect.DeepEqual(test_bins[0].Fwd, []float64{10, 10}) ||
+		!reflect.DeepEqual(test_bins[2].Fwd, []float64{70, 50}) ||
+		!reflect.DeepEqual(test_bins[2].Rvs, []float64{0, 0}) {
+		fmt.Println(test_bins[0], test_bins[2])
+		t.Error("Bin counts are incorrect")
+	}
+
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	BinsToCsv(BinProfile(test_profile, test_ref, 100, 50), test_ref, 20, out_prefix, []string{"a", "b"})
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_20_bins.csv")
+	csv_lines := strings.Split(strings.TrimSpace(string(csv_data)), "\n")
+	if len(csv_lines) != 6 || csv_lines[0] != "Header,Start,End,Fwd a,Fwd b,Rvs a,Rvs b" ||
+		csv_lines[3] != "ref_1,101,200,70.000,50.000,0.000,0.000" {
+		fmt.Println(string(csv_data))
+		t.Error("Bins csv is incorrect")
+	}
+	BinsToBedGraph(BinProfile(test_profile, test_ref, 50, 50), test_ref, 20, out_prefix)
+	bedgraph, _ := ioutil.ReadFile(out_prefix + "_20_bins_fwd.bedgraph")
+	bedgraph_lines := strings.Split(strings.TrimSpace(string(bedgraph)), "\n")
+	if len(bedgraph_lines) != 7 || bedgraph_lines[1] != "ref_1\t0\t50\t6.000" ||
+		bedgraph_lines[3] != "ref_1\t100\t150\t56.000" || bedgraph_lines[6] != "ref_1\t250\t300\t4.000" {
+		fmt.Println(string(bedgraph))
+		t.Error("Bins bedGraph is incorrect")
+	}
+}
+
+func TestRefLoadWithOptions(t *testing.T) {
+	test_ref := RefLoadWithOptions("./test_data/test_ref_align.fa", &RefOptions{Headers: []string{"ref_1"},
+		Pattern: "_3$"})
+	if len(test_ref) != 2 || test_ref[0].Header != "ref_1" || test_ref[1].Header != "ref_3" {
+		t.Error("Reference headers are not selected correctly")
+	}
+
+	test_ref = RefLoadWithOptions("./test_data/test_ref_align.fa", &RefOptions{Regions: []string{"ref_2:25-50"},
+		RegionFile: "./test_data/test_regions.bed"})
+	should_be := []*HeaderRef{
+		{"ref_1:1-10", "AAAAAAAAAA", "TTTTTTTTTT", "ref_1:1-10", ""},
+		{"ref_2:25-50", "TAAAAAAAAAAAAAAAAAAAAAAAAG", "CTTTTTTTTTTTTTTTTTTTTTTTTA", "ref_2:25-50", ""},
+	}
+	if !reflect.DeepEqual(test_ref, should_be) {
+		for _, ref := range test_ref {
+			fmt.Println(*ref)
+		}
+		t.Fatal("Reference regions are incorrect")
+	}
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_seq_1.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_align := AlignReads(test_seq, test_ref, 24)
+	if !reflect.DeepEqual(test_align["ref_2:25-50"], map[string][]int{"AAAAAAAAAAAAAAAAAAAAAAAA": {2}}) {
+		fmt.Println(test_align)
+		t.Error("Region alignment positions are incorrect")
+	}
+}
+
+func TestRefDescriptions(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_ref_desc.fa")
+	if test_ref[0].Header != "NC_000001.1" || test_ref[0].ID != "NC_000001.1" ||
+		test_ref[0].Description != "Test virus 1, complete genome" || test_ref[1].Description != "Test virus 2" {
+		t.Error("Reference IDs and descriptions are incorrect")
+	}
+
+	var seq_files []string
+	seq_files = append(seq_files, "./test_data/test_seq_1.fa")
+	test_seq := SeqLoad(seq_files, "cfa", "nil", 18, 32, 1.0, false)
+	test_profile := ProfileNoSplit(AlignReads(test_seq, test_ref, 24), test_seq)
+	for header_mode, should_be := range map[string]string{
+		"id":          "Header,len,sRNA",
+		"description": "Description,len,sRNA",
+		"both":        "Header,Description,len,sRNA",
+	} {
+		var buf bytes.Buffer
+		WriteProfile(&buf, test_profile, test_ref, nil, &OutputOptions{Format: "csv", Precision: 3, SePrecision: 8,
+			FloatFormat: 'f', HeaderMode: header_mode, Descriptions: RefDescriptions(test_ref)})
+		csv_lines := strings.Split(buf.String(), "\n")
+		if !strings.HasPrefix(csv_lines[0], should_be) {
+			t.Error("Header mode " + header_mode + " columns are incorrect")
+		}
+		if header_mode == "both" && !strings.HasPrefix(csv_lines[1], "NC_000001.1,\"Test virus 1, complete genome\",25,") {
+			fmt.Println(buf.String())
+			t.Error("Header mode both row is incorrect")
+		}
+	}
+}
+
+func TestDuplicateHeaders(t *testing.T) {
+	test_ref := RefLoad("./test_data/test_ref_dup.fa")
+	var headers []string
+	for _, ref := range test_ref {
+		headers = append(headers, ref.Header)
+	}
+	if !reflect.DeepEqual(headers, []string{"ref_a", "ref_b", "ref_a_3", "ref_a_2"}) ||
+		test_ref[2].Seq != "GGGGGGGGGG" || test_ref[2].Description != "second" {
+		fmt.Println(headers)
+		t.Error("Duplicate reference headers are not suffixed")
+	}
+
+	test_ref = RefLoadWithOptions("./test_data/test_ref_dup.fa", &RefOptions{Duplicates: "merge"})
+	if len(test_ref) != 3 || test_ref[0].Seq != "AAAAAAAAAANGGGGGGGGGG" ||
+		test_ref[0].ReverseSeq != "CCCCCCCCCCNTTTTTTTTTT" {
+		t.Error("Duplicate reference headers are not merged")
+	}
+
+	test_mir_ref := MirLoad("./test_data/test_mir_dup.fa")
+	// the second mir_a skips mir_a_2, which is a later header in the file
+	if len(test_mir_ref) != 5 || test_mir_ref["mir_a_3"] == nil || test_mir_ref["mir_a"].dup != 2 ||
+		test_mir_ref["mir_a_2"].seq != "TTCCACAGCTTTCTTGAACTG" {
+		t.Error("Duplicate miRNA headers are not suffixed")
+	}
+	test_mir_ref = MirLoadWithOptions("./test_data/test_mir_dup.fa", &MirOptions{Duplicates: "merge"})
+	if len(test_mir_ref) != 4 || test_mir_ref["mir_a"].dup != 1 || test_mir_ref["mir_b_2"] == nil {
+		t.Error("Duplicate miRNA headers are not merged")
+	}
+}
+
+func TestRefValidation(t *testing.T) {
+	test_ref := RefLoadWithOptions("./test_data/test_ref_invalid.fa",
+		&RefOptions{Validation: &ValidationOptions{MinLength: 5}})
+	var headers []string
+	for _, ref := range test_ref {
+		headers = append(headers, ref.Header)
+	}
+	if !reflect.DeepEqual(headers, []string{"ref_gaps", "ref_iupac", "ref_bad", "ref_short", "ref_rna"}) ||
+		test_ref[0].Seq != "ACGTACGTACGT" || test_ref[0].Description != "gapped alignment" ||
+		test_ref[2].Seq != "ACGTNACGTN" || test_ref[4].Seq != "ACGTACGT" {
+		fmt.Println(headers)
+		t.Error("Reference sequences are not validated with the default policies")
+	}
+	if test_ref[1].Seq != "ACGTRYKMACGTN" || test_ref[1].ReverseSeq != "NACGTKMRYACGT" {
+		t.Error("IUPAC reference sequences are not reverse complemented")
+	}
+
+	_, report := RefLoadWithReport("./test_data/test_ref_invalid.fa",
+		&RefOptions{Validation: &ValidationOptions{MinLength: 5}})
+	if len(report) == 0 || report[0].Issue != "Windows (CRLF) line endings" || report[0].Count == 0 {
+		t.Error("Windows line endings are not reported")
+	}
+	RefIssuesToCsv(report, "./test_data/test_ref_report")
+	report_file, err := os.ReadFile("./test_data/test_ref_report_ref_issues.csv")
+	os.Remove("./test_data/test_ref_report_ref_issues.csv")
+	if err != nil || strings.Count(string(report_file), "\n") != len(report)+1 {
+		t.Error("Reference issue report is not written")
+	}
+
+	test_ref = RefLoad("./test_data/test_ref_invalid.fa")
+	if len(test_ref) != 6 || test_ref[0].Seq != "ACGT--ACGTAC..GT" || test_ref[0].Description != "gapped alignment" {
+		t.Error("Windows line endings are not removed from reference sequences")
+	}
+	scanner := bufio.NewScanner(strings.NewReader(">ref_1\r\nACGT\nAC\r\nGT"))
+	scanner.Split(scanLinesKeepCR)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if !reflect.DeepEqual(lines, []string{">ref_1\r", "ACGT", "AC\r", "GT"}) {
+		fmt.Printf("%q\n", lines)
+		t.Error("Carriage returns are not kept for counting Windows line endings")
+	}
+
+	loaded := *test_ref[0]
+	validated, issues := ValidateRefs(test_ref, &ValidationOptions{NonIupac: "reject", Gaps: "N", Short: "reject",
+		MinLength: 5})
+	if len(validated) != 3 || validated[0].Seq != "ACGTNNACGTACNNGT" || *test_ref[0] != loaded {
+		t.Error("Reference sequences are not validated without changing the input sequences")
+	}
+	var actions []string
+	for _, issue := range issues {
+		actions = append(actions, issue.Header+": "+issue.Action)
+	}
+	if !reflect.DeepEqual(actions, []string{"ref_gaps: replaced with N", "ref_bad: rejected",
+		"ref_empty: rejected", "ref_short: rejected", "ref_rna: converted to T"}) {
+		fmt.Println(actions)
+		t.Error("Reference sequence issues are not reported")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	json_config := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(json_config, []byte(`{"readFileSet1": ["./test_data/test_seq_1.fa"], "alignTo": "./test_data/`+
+		`test_ref_align.fa", "length": [21, 24], "outFile": "`+filepath.Join(dir, "out")+`", "noSplit": true}`), 0644)
+	config, err := LoadConfig(json_config)
+	if err != nil || config.Validate() != nil || !reflect.DeepEqual(config.Length, []int{21, 24}) ||
+		!config.NoSplit || config.MinLen != 18 || config.FileType != "cfa" {
+		fmt.Println(config, err)
+		t.Error("JSON config is not loaded")
+	}
+
+	saved_config := filepath.Join(dir, "saved.json")
+	if err := config.Save(saved_config); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := LoadConfig(saved_config)
+	if err != nil || !reflect.DeepEqual(saved, config) {
+		fmt.Println(saved, err)
+		t.Error("Config is not saved and loaded")
+	}
+
+	config.MinLen = 25
+	config.MaxLen = 20
+	config.Format = "xml"
+	config.ReadFileSet1 = append(config.ReadFileSet1, "./test_data/missing.fa")
+	err = config.Validate()
+	for _, problem := range []string{"minLen (25) is greater than maxLen (20)", "format must be csv",
+		"read file ./test_data/missing.fa", "length 21 is outside minLen to maxLen (25-20)"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			fmt.Println(err)
+			t.Error("Config validation does not report: " + problem)
+		}
+	}
+
+	ioutil.WriteFile(json_config, []byte(`{"minLen": 18, "maxLength": 30}`), 0644)
+	if _, err := LoadConfig(json_config); err == nil || !strings.Contains(err.Error(), "maxLength") {
+		t.Error("Unknown config options should return an error")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	out_prefix := filepath.Join(t.TempDir(), "test")
+	manifest := NewManifest(map[string]int{"length": 24}, "./test_data/test_seq_1.fa", "./test_data/test_ref_align.fa")
+	test_ref := RefLoad("./test_data/test_ref_align.fa")
+	test_seq := SeqLoad([]string{"./test_data/test_seq_1.fa"}, "cfa", "nil", 18, 32, 1.0, false)
+	ProfileToCsv(ProfileNoSplit(AlignReads(test_seq, test_ref, 24), test_seq), test_ref, 24, out_prefix, nil)
+	if err := manifest.Write(out_prefix + "_manifest.json"); err != nil {
+		t.Fatal(err)
+	}
+	input_file := "./test_data/test_seq_1.fa"
+
+	manifest_data, _ := ioutil.ReadFile(out_prefix + "_manifest.json")
+	var written Manifest
+	if err := json.Unmarshal(manifest_data, &written); err != nil {
+		t.Fatal(err)
+	}
+	seq_data, _ := ioutil.ReadFile("./test_data/test_seq_1.fa")
+	seq_sum := sha256.Sum256(seq_data)
+	csv_data, _ := ioutil.ReadFile(out_prefix + "_24.csv")
+	csv_sum := sha256.Sum256(csv_data)
+	should_be_inputs := manifestFile{"./test_data/test_seq_1.fa", int64(len(seq_data)), hex.EncodeToString(seq_sum[:])}
+	should_be_outputs := []manifestFile{{out_prefix + "_24.csv", int64(len(csv_data)), hex.EncodeToString(csv_sum[:])}}
+	if written.Version != Version || len(written.Inputs) != 2 || written.Inputs[0] != should_be_inputs ||
+		!reflect.DeepEqual(written.Outputs, should_be_outputs) ||
+		!reflect.DeepEqual(written.Libraries, []libraryTotal{{"./test_data/test_seq_1.fa", 100}}) ||
+		written.Parameters.(map[string]interface{})["length"] != 24.0 || written.Finished.Before(written.Started) {
+		fmt.Println(string(manifest_data))
+		t.Error("Run manifest is incorrect")
+	}
+	if err := manifest.Write(out_prefix + "_manifest.json"); err == nil {
+		t.Error("Writing a manifest twice should return an error")
+	}
+
+	// the run log is trimmed when manifests are written, and only records while a manifest is open
+	first := NewManifest(nil)
+	recordOutput(out_prefix + "_24.csv")
+	second := NewManifest(nil)
+	recordOutput(input_file)
+	second.Write(out_prefix + "_second.json")
+	if len(runLog.outputs) != 3 || len(second.Outputs) != 1 || second.Outputs[0].Path != input_file {
+		t.Error("Overlapping manifest outputs are incorrect", runLog.outputs)
+	}
+	first.Write(out_prefix + "_first.json")
+	recordOutput(out_prefix + "_24.csv")
+	if len(runLog.outputs) != 0 || len(runLog.open) != 0 || len(first.Outputs) != 3 {
+		t.Error("Run log is not trimmed", runLog.outputs, first.Outputs)
+	}
+
+	// a discarded manifest no longer holds run log entries, and can't be written
+	discarded := NewManifest(nil)
+	recordOutput(input_file)
+	discarded.Discard()
+	if len(runLog.outputs) != 0 || len(runLog.open) != 0 {
+		t.Error("Run log is not trimmed when a manifest is discarded", runLog.outputs)
+	}
+	if err := discarded.Write(out_prefix + "_discarded.json"); err == nil {
+		t.Error("Writing a discarded manifest should return an error")
+	}
+}
@@ -0,0 +1,194 @@
+package scramPkg
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationOptions are the policies for the reference sequence issues found by ValidateRefs.  Character policies are
+// "strip" (remove the characters), "N" (replace them with N) or "reject" (drop the sequence).  Sequence policies are
+// "keep" or "reject".
+type ValidationOptions struct {
+	NonIupac  string // NonIupac is the policy for non-IUPAC characters - "strip", "N" (the default) or "reject"
+	Gaps      string // Gaps is the policy for gap characters ('-' or '.') - "strip" (the default), "N" or "reject"
+	Empty     string // Empty is the policy for empty sequences - "keep" or "reject" (the default)
+	Short     string // Short is the policy for sequences shorter than MinLength - "keep" (the default) or "reject"
+	MinLength int    // MinLength is the min. sequence length (e.g. the read length).  Not checked if 0.
+}
+
+// DefaultValidationOptions returns the default reference sequence validation policies
+func DefaultValidationOptions() *ValidationOptions {
+	return &ValidationOptions{NonIupac: "N", Gaps: "strip", Empty: "reject", Short: "keep"}
+}
+
+// RefIssue is an issue found in a reference sequence by ValidateRefs (or in a reference file by RefLoadWithOptions),
+// and the action taken
+type RefIssue struct {
+	Header string // Header is the reference header, or the file name for file issues
+	Issue  string // Issue describes the issue, e.g. "non-IUPAC characters ('X', 'Z')"
+	Count  int    // Count is the no. of characters affected (0 for sequence issues)
+	Action string // Action is the action taken, e.g. "replaced with N"
+}
+
+// iupacNts are the IUPAC nucleotide codes accepted in a reference sequence
+const iupacNts = "ACGTNRYSWKMBDHV"
+
+// Checks the validation policies are valid, and fills in the defaults for any not set
+func checkValidationOptions(opts *ValidationOptions) {
+	defaults := DefaultValidationOptions()
+	for _, policy := range []struct {
+		name    string
+		value   *string
+		def     string
+		allowed []string
+	}{
+		{"non-IUPAC character", &opts.NonIupac, defaults.NonIupac, []string{"strip", "N", "reject"}},
+		{"gap", &opts.Gaps, defaults.Gaps, []string{"strip", "N", "reject"}},
+		{"empty sequence", &opts.Empty, defaults.Empty, []string{"keep", "reject"}},
+		{"short sequence", &opts.Short, defaults.Short, []string{"keep", "reject"}},
+	} {
+		if *policy.value == "" {
+			*policy.value = policy.def
+		}
+		valid := false
+		for _, allowed := range policy.allowed {
+			valid = valid || *policy.value == allowed
+		}
+		if !valid {
+			fmt.Println("\nReference " + policy.name + " policy must be one of " + fmt.Sprint(policy.allowed) +
+				", not " + *policy.value)
+			errorShutdown()
+		}
+	}
+}
+
+// ValidateRefs checks each reference sequence for non-IUPAC characters, gaps ('-' or '.'), empty sequences and
+// sequences shorter than opts.MinLength, and applies the policy for each issue found.  Whitespace is always stripped,
+// and U is converted to T.  Sequences are checked after they have been uppercased by the loader.
+// It returns the reference sequences that were not rejected and the issues found, in refSlice order.  Fixed sequences
+// are returned as copies (with new reverse complements) - refSlice is not changed.
+func ValidateRefs(refSlice []*HeaderRef, opts *ValidationOptions) ([]*HeaderRef, []*RefIssue) {
+	if opts == nil {
+		opts = DefaultValidationOptions()
+	}
+	checkValidationOptions(opts)
+	var validated []*HeaderRef
+	var issues []*RefIssue
+	for _, ref := range refSlice {
+		var cleaned bytes.Buffer
+		var spaces, us, gaps, nonIupac int
+		invalidChars := make(map[rune]bool)
+		for _, nt := range ref.Seq {
+			switch {
+			case nt == ' ' || nt == '\t':
+				spaces++
+			case nt == 'U':
+				us++
+				cleaned.WriteByte('T')
+			case nt == '-' || nt == '.':
+				gaps++
+				if opts.Gaps == "N" {
+					cleaned.WriteByte('N')
+				}
+			case strings.ContainsRune(iupacNts, nt):
+				cleaned.WriteRune(nt)
+			default:
+				nonIupac++
+				invalidChars[nt] = true
+				if opts.NonIupac == "N" {
+					cleaned.WriteByte('N')
+				}
+			}
+		}
+
+		var refIssues []*RefIssue
+		rejected := false
+		addIssue := func(issue string, count int, policy string) {
+			action := charActions[policy]
+			if policy == "reject" {
+				rejected = true
+			}
+			refIssues = append(refIssues, &RefIssue{ref.Header, issue, count, action})
+		}
+		if spaces > 0 {
+			addIssue("whitespace", spaces, "strip")
+		}
+		if us > 0 {
+			refIssues = append(refIssues, &RefIssue{ref.Header, "U (RNA) bases", us, "converted to T"})
+		}
+		if gaps > 0 {
+			addIssue("gaps", gaps, opts.Gaps)
+		}
+		if nonIupac > 0 {
+			var chars []string
+			for nt := range invalidChars {
+				chars = append(chars, strconv.QuoteRune(nt))
+			}
+			sort.Strings(chars)
+			addIssue("non-IUPAC characters ("+strings.Join(chars, ", ")+")", nonIupac, opts.NonIupac)
+		}
+		seq := cleaned.String()
+		switch {
+		case len(seq) == 0:
+			addIssue("empty sequence", 0, opts.Empty)
+		case len(seq) < opts.MinLength:
+			addIssue("shorter than "+strconv.Itoa(opts.MinLength)+" nt", 0, opts.Short)
+		}
+		if rejected {
+			for _, issue := range refIssues {
+				if issue.Action != "rejected" {
+					issue.Action += " - sequence rejected"
+				}
+			}
+		} else {
+			if seq != ref.Seq {
+				fixed := *ref
+				fixed.Seq = seq
+				fixed.ReverseSeq = reverseComplement(seq)
+				ref = &fixed
+			}
+			validated = append(validated, ref)
+		}
+		issues = append(issues, refIssues...)
+	}
+	return validated, issues
+}
+
+// charActions are the descriptions of the actions for each validation policy
+var charActions = map[string]string{
+	"strip":  "stripped",
+	"N":      "replaced with N",
+	"reject": "rejected",
+	"keep":   "kept",
+}
+
+// reportRefIssues prints a warning listing the reference sequence issues and the actions taken
+func reportRefIssues(issues []*RefIssue) {
+	if len(issues) == 0 {
+		return
+	}
+	fmt.Println("Warning: " + strconv.Itoa(len(issues)) + " reference sequence issue(s)")
+	for _, issue := range issues {
+		description := issue.Issue
+		if issue.Count > 0 {
+			description += " x " + strconv.Itoa(issue.Count)
+		}
+		fmt.Println("  " + issue.Header + " - " + description + " - " + issue.Action)
+	}
+}
+
+// RefIssuesToCsv writes the reference sequence issues found by ValidateRefs or RefLoadWithReport to a csv file.
+func RefIssuesToCsv(issues []*RefIssue, outPrefix string) {
+	writeTable(outPrefix+"_ref_issues.csv", nil, func(emit emitRow) error {
+		columns := []string{"Header", "Issue", "Count", "Action"}
+		for _, issue := range issues {
+			if err := emit(columns, []interface{}{issue.Header, issue.Issue, issue.Count, issue.Action}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,517 @@
+package scramPkg
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// OutputOptions are the options for writing tabular output (e.g. with CompareToFile and ProfileToFile).  Only the
+// functions that take OutputOptions apply them - the *ToCsv functions write csv with fixed options, and report
+// reference IDs in the Header column whatever the HeaderMode.
+type OutputOptions struct {
+	Format      string // Format is "csv", "tsv", "jsonl" (JSON Lines) or "col" (compact binary columnar)
+	Precision   int    // Precision is the no. of digits for counts and other floats (as per strconv.FormatFloat)
+	SePrecision int    // SePrecision is the no. of digits for standard errors
+	FloatFormat byte   // FloatFormat is the strconv.FormatFloat format - 'f', 'e' or 'g'
+	Gzip        bool   // Gzip compresses the output
+	// HeaderMode is "id" (the default) to report the reference ID in the Header column, "description" to report the
+	// description instead, or "both" to add a Description column after the Header column
+	HeaderMode   string
+	Descriptions map[string]string // Descriptions are the ID : description maps (from RefDescriptions or MirnaDescriptions)
+}
+
+// DefaultOutputOptions returns the options used by CompareToCsv and ProfileToCsv - csv, with counts to 3 decimal
+// places and standard errors to 8 decimal places.
+func DefaultOutputOptions() *OutputOptions {
+	return &OutputOptions{Format: "csv", Precision: 3, SePrecision: 8, FloatFormat: 'f'}
+}
+
+// fileExt returns the output file extension for the options
+func (opts *OutputOptions) fileExt() string {
+	ext := map[string]string{"csv": ".csv", "tsv": ".tsv", "jsonl": ".jsonl", "col": ".scol"}[opts.Format]
+	if opts.Gzip {
+		ext += ".gz"
+	}
+	return ext
+}
+
+// stdErr is a standard error value in an output row, formatted with SePrecision
+type stdErr float64
+
+// formatValue formats a single output value (string, int, float64 or stdErr) as text
+func (opts *OutputOptions) formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, opts.FloatFormat, opts.Precision, 64)
+	case stdErr:
+		return strconv.FormatFloat(float64(v), opts.FloatFormat, opts.SePrecision, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// RowWriter writes rows of tabular output.  Row values are strings, ints, float64 counts or standard errors.  Rows are
+// not retained, so the caller may reuse the values slice once WriteRow returns.
+type RowWriter interface {
+	WriteHeader(columns []string) error
+	WriteRow(values []interface{}) error
+	Close() error // Close flushes the output (and closes gzip compression), but not the underlying io.Writer
+}
+
+// NewRowWriter returns a RowWriter for the format in opts (DefaultOutputOptions if nil) that writes to w.
+func NewRowWriter(w io.Writer, opts *OutputOptions) (RowWriter, error) {
+	if opts == nil {
+		opts = DefaultOutputOptions()
+	}
+	if opts.FloatFormat != 'f' && opts.FloatFormat != 'e' && opts.FloatFormat != 'g' {
+		return nil, fmt.Errorf("float format must be 'f', 'e' or 'g', not %q", opts.FloatFormat)
+	}
+	if opts.HeaderMode != "" && opts.HeaderMode != "id" && opts.HeaderMode != "description" &&
+		opts.HeaderMode != "both" {
+		return nil, errors.New("header mode must be id, description or both, not " + opts.HeaderMode)
+	}
+	var gz *gzip.Writer
+	if opts.Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	bw := bufio.NewWriterSize(w, 1<<16)
+	base := &baseWriter{bw: bw, gz: gz, opts: opts}
+	switch opts.Format {
+	case "csv", "tsv":
+		cw := csv.NewWriter(bw)
+		if opts.Format == "tsv" {
+			cw.Comma = '\t'
+		}
+		return &delimitedWriter{baseWriter: base, cw: cw}, nil
+	case "jsonl":
+		return &jsonlWriter{baseWriter: base}, nil
+	case "col":
+		return &columnarWriter{baseWriter: base}, nil
+	}
+	return nil, errors.New("output format must be csv, tsv, jsonl or col, not " + opts.Format)
+}
+
+// baseWriter is the buffered (and optionally gzip compressed) output shared by the row writers
+type baseWriter struct {
+	bw   *bufio.Writer
+	gz   *gzip.Writer
+	opts *OutputOptions
+}
+
+func (base *baseWriter) close() error {
+	if err := base.bw.Flush(); err != nil {
+		return err
+	}
+	if base.gz != nil {
+		return base.gz.Close()
+	}
+	return nil
+}
+
+// delimitedWriter writes csv or tsv rows
+type delimitedWriter struct {
+	*baseWriter
+	cw     *csv.Writer
+	record []string
+}
+
+func (dw *delimitedWriter) WriteHeader(columns []string) error {
+	if len(columns) == 0 {
+		return nil
+	}
+	return dw.cw.Write(columns)
+}
+
+func (dw *delimitedWriter) WriteRow(values []interface{}) error {
+	dw.record = dw.record[:0]
+	for _, value := range values {
+		dw.record = append(dw.record, dw.opts.formatValue(value))
+	}
+	return dw.cw.Write(dw.record)
+}
+
+func (dw *delimitedWriter) Close() error {
+	dw.cw.Flush()
+	if err := dw.cw.Error(); err != nil {
+		return err
+	}
+	return dw.close()
+}
+
+// jsonlWriter writes each row as a JSON object (keyed by column name) on a single line
+type jsonlWriter struct {
+	*baseWriter
+	columns []string
+}
+
+// WriteHeader sets the keys of each row.  Repeated column names (e.g. the same read file in both sets of a compare) are
+// made unique with a _2, _3, ... suffix, as JSON objects can't have duplicate keys.
+func (jw *jsonlWriter) WriteHeader(columns []string) error {
+	jw.columns = make([]string, len(columns))
+	used := make(map[string]bool)
+	for _, column := range columns {
+		used[column] = true
+	}
+	seen := make(map[string]bool)
+	for i, column := range columns {
+		key := column
+		for suffix := 2; seen[key] || (key != column && used[key]); suffix++ {
+			key = column + "_" + strconv.Itoa(suffix)
+		}
+		seen[key] = true
+		jw.columns[i] = key
+	}
+	return nil
+}
+
+func (jw *jsonlWriter) WriteRow(values []interface{}) error {
+	if len(values) != len(jw.columns) {
+		return fmt.Errorf("row has %d values but there are %d columns", len(values), len(jw.columns))
+	}
+	var line bytes.Buffer
+	line.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			line.WriteByte(',')
+		}
+		key, _ := json.Marshal(jw.columns[i])
+		line.Write(key)
+		line.WriteByte(':')
+		switch v := value.(type) {
+		case float64, stdErr:
+			// JSON has no NaN or Inf
+			if f := reflectFloat(v); math.IsNaN(f) || math.IsInf(f, 0) {
+				line.WriteString("null")
+			} else {
+				line.WriteString(jw.opts.formatValue(v))
+			}
+		case int:
+			line.WriteString(strconv.Itoa(v))
+		default:
+			text, _ := json.Marshal(jw.opts.formatValue(v))
+			line.Write(text)
+		}
+	}
+	line.WriteString("}\n")
+	_, err := jw.bw.Write(line.Bytes())
+	return err
+}
+
+func (jw *jsonlWriter) Close() error {
+	return jw.close()
+}
+
+// Returns the float64 value of a float64 or stdErr
+func reflectFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case stdErr:
+		return float64(v)
+	}
+	return 0
+}
+
+// columnarMagic identifies the compact binary columnar format
+const columnarMagic = "SCRAMCOL\x01"
+
+// columnarBlockRows is the no. of rows in each block of the columnar format
+const columnarBlockRows = 65536
+
+// columnarWriter writes the compact binary columnar format.  The file is the magic, the no. of columns and the column
+// names, then blocks of up to columnarBlockRows rows, each stored column by column, and finally an empty block.  Each
+// column of a block has a type byte - 'i' (varint), 'f' (float64, little endian) or 's' (uvarint length prefixed
+// string) - followed by its values.  Floats are stored at full precision.
+type columnarWriter struct {
+	*baseWriter
+	columns []string
+	block   [][]interface{}
+}
+
+func (cw *columnarWriter) WriteHeader(columns []string) error {
+	cw.columns = columns
+	cw.bw.WriteString(columnarMagic)
+	writeUvarint(cw.bw, uint64(len(columns)))
+	for _, column := range columns {
+		writeColumnarString(cw.bw, column)
+	}
+	return nil
+}
+
+func (cw *columnarWriter) WriteRow(values []interface{}) error {
+	if len(values) != len(cw.columns) {
+		return fmt.Errorf("row has %d values but there are %d columns", len(values), len(cw.columns))
+	}
+	cw.block = append(cw.block, append([]interface{}(nil), values...))
+	if len(cw.block) == columnarBlockRows {
+		return cw.writeBlock()
+	}
+	return nil
+}
+
+func (cw *columnarWriter) writeBlock() error {
+	writeUvarint(cw.bw, uint64(len(cw.block)))
+	for col := range cw.columns {
+		colType := byte('s')
+		switch cw.block[0][col].(type) {
+		case int:
+			colType = 'i'
+		case float64, stdErr:
+			colType = 'f'
+		}
+		for _, row := range cw.block {
+			switch row[col].(type) {
+			case int:
+				if colType != 'i' {
+					colType = 's'
+				}
+			case float64, stdErr:
+				if colType != 'f' {
+					colType = 's'
+				}
+			default:
+				colType = 's'
+			}
+		}
+		cw.bw.WriteByte(colType)
+		for _, row := range cw.block {
+			switch colType {
+			case 'i':
+				var buf [binary.MaxVarintLen64]byte
+				cw.bw.Write(buf[:binary.PutVarint(buf[:], int64(row[col].(int)))])
+			case 'f':
+				binary.Write(cw.bw, binary.LittleEndian, reflectFloat(row[col]))
+			default:
+				writeColumnarString(cw.bw, cw.opts.formatValue(row[col]))
+			}
+		}
+	}
+	cw.block = cw.block[:0]
+	return nil
+}
+
+func (cw *columnarWriter) Close() error {
+	if len(cw.block) > 0 {
+		if err := cw.writeBlock(); err != nil {
+			return err
+		}
+	}
+	writeUvarint(cw.bw, 0)
+	return cw.close()
+}
+
+func writeUvarint(w *bufio.Writer, x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], x)])
+}
+
+func writeColumnarString(w *bufio.Writer, s string) {
+	writeUvarint(w, uint64(len(s)))
+	w.WriteString(s)
+}
+
+// ReadColumnar reads a file in the compact binary columnar format (uncompressed).  It returns the column names and the
+// rows, with values as int, float64 or string.
+func ReadColumnar(r io.Reader) ([]string, [][]interface{}, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(columnarMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != columnarMagic {
+		return nil, nil, errors.New("not a scram columnar file")
+	}
+	noCols, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	columns := make([]string, noCols)
+	for col := range columns {
+		if columns[col], err = readColumnarString(br); err != nil {
+			return nil, nil, err
+		}
+	}
+	var rows [][]interface{}
+	for {
+		noRows, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		if noRows == 0 {
+			return columns, rows, nil
+		}
+		block := make([][]interface{}, noRows)
+		for i := range block {
+			block[i] = make([]interface{}, noCols)
+		}
+		for col := 0; col < int(noCols); col++ {
+			colType, err := br.ReadByte()
+			if err != nil {
+				return nil, nil, err
+			}
+			for i := range block {
+				switch colType {
+				case 'i':
+					v, err := binary.ReadVarint(br)
+					if err != nil {
+						return nil, nil, err
+					}
+					block[i][col] = int(v)
+				case 'f':
+					var v float64
+					if err := binary.Read(br, binary.LittleEndian, &v); err != nil {
+						return nil, nil, err
+					}
+					block[i][col] = v
+				case 's':
+					v, err := readColumnarString(br)
+					if err != nil {
+						return nil, nil, err
+					}
+					block[i][col] = v
+				default:
+					return nil, nil, fmt.Errorf("unknown column type %q", colType)
+				}
+			}
+		}
+		rows = append(rows, block...)
+	}
+}
+
+func readColumnarString(br *bufio.Reader) (string, error) {
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	s := make([]byte, length)
+	_, err = io.ReadFull(br, s)
+	return string(s), err
+}
+
+// emitRow writes a single row of a table.  The columns are the same for every row of the table.
+type emitRow func(columns []string, row []interface{}) error
+
+// streamTable writes the rows generated by table to w in the format set by opts (DefaultOutputOptions if nil).  The
+// header is written before the first row, and each row is written as it is generated, so the whole table is never
+// held in memory.  An empty table has no header.
+func streamTable(w io.Writer, opts *OutputOptions, table func(emit emitRow) error) error {
+	rw, err := NewRowWriter(w, opts)
+	if err != nil {
+		return err
+	}
+	headerWritten := false
+	err = table(describe(opts, func(columns []string, row []interface{}) error {
+		if !headerWritten {
+			if err := rw.WriteHeader(columns); err != nil {
+				return err
+			}
+			headerWritten = true
+		}
+		return rw.WriteRow(row)
+	}))
+	if err != nil {
+		return err
+	}
+	if !headerWritten {
+		if err := rw.WriteHeader(nil); err != nil {
+			return err
+		}
+	}
+	return rw.Close()
+}
+
+// describe wraps emit to report the description for the Header column of each row, as set by opts.HeaderMode
+func describe(opts *OutputOptions, emit emitRow) emitRow {
+	if opts == nil || opts.HeaderMode == "" || opts.HeaderMode == "id" {
+		return emit
+	}
+	var describedColumns []string
+	var describedRow []interface{}
+	return func(columns []string, row []interface{}) error {
+		if len(columns) == 0 || columns[0] != "Header" {
+			return emit(columns, row)
+		}
+		id, _ := row[0].(string)
+		description, ok := opts.Descriptions[id]
+		if !ok || description == "" {
+			description = id
+		}
+		switch opts.HeaderMode {
+		case "description":
+			if describedColumns == nil {
+				describedColumns = append([]string{"Description"}, columns[1:]...)
+			}
+			describedRow = append(append(describedRow[:0], description), row[1:]...)
+		default:
+			if describedColumns == nil {
+				describedColumns = append([]string{"Header", "Description"}, columns[1:]...)
+			}
+			describedRow = append(append(describedRow[:0], id, description), row[1:]...)
+		}
+		return emit(describedColumns, describedRow)
+	}
+}
+
+// writeFileAtomic creates outFile (and the save directory if required) by passing a temporary file in the same
+// directory to write, then renaming it to outFile.  A partial outFile is never left if write fails.
+func writeFileAtomic(outFile string, write func(w io.Writer) error) error {
+	outDir := filepath.Dir(outFile)
+	if err := os.MkdirAll(outDir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := createTempFile(outFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), outFile); err != nil {
+		return err
+	}
+	recordOutput(outFile)
+	return nil
+}
+
+// createTempFile creates a new temporary file next to outFile.  Unlike ioutil.TempFile (mode 0600), the file is
+// created with mode 0666 less the umask, as os.Create would create outFile.
+func createTempFile(outFile string) (*os.File, error) {
+	prefix := filepath.Join(filepath.Dir(outFile), "."+filepath.Base(outFile)+".tmp")
+	for {
+		f, err := os.OpenFile(prefix+strconv.FormatUint(uint64(rand.Uint32()), 36), os.O_RDWR|os.O_CREATE|os.O_EXCL,
+			0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+// writeTable writes the rows generated by table to outFile in the format set by opts (DefaultOutputOptions if nil),
+// exiting if the file can't be written
+func writeTable(outFile string, opts *OutputOptions, table func(emit emitRow) error) {
+	err := writeFileAtomic(outFile, func(w io.Writer) error {
+		return streamTable(w, opts, table)
+	})
+	if err != nil {
+		fmt.Println("\nCan't write " + outFile + ": " + err.Error())
+		errorShutdown()
+	}
+}